@@ -1,23 +1,153 @@
 package push
 
-import "sync"
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Cache is an interface that allows Middleware and ResponseWriter to cache the results of the list of resources to improve performance.
+// Set must replace the resources of an URI atomically, Middleware and ResponseWriter only call it after a response has been parsed successfully.
 type Cache interface {
 	Get(string) ([]string, bool)
 	Add(string, string)
+	Set(string, []string)
 	Del(string)
 }
 
+// ValidatingCache is a Cache that stores a validator with each entry, such as the ETag of the response the resources were found in. Middleware and ResponseWriter use it to parse the response again when its validator differs.
+type ValidatingCache interface {
+	Cache
+	GetValidated(string) ([]string, string, bool)
+	SetValidated(string, []string, string)
+}
+
+////////////////
+
+// CacheKeyFunc returns the key of the cache entry for a request.
+type CacheKeyFunc func(*http.Request) string
+
+// RequestURIKey is the default CacheKeyFunc and returns the request URI.
+func RequestURIKey(r *http.Request) string {
+	return r.RequestURI
+}
+
+// HostKey is a CacheKeyFunc that returns the host of the request.
+func HostKey(r *http.Request) string {
+	return r.Host
+}
+
+// HeaderKey returns a CacheKeyFunc that returns the values of the request headers with the given names.
+func HeaderKey(names ...string) CacheKeyFunc {
+	return func(r *http.Request) string {
+		return headerKey(r, names)
+	}
+}
+
+// CookieKey returns a CacheKeyFunc that returns the values of the request cookies with the given names.
+func CookieKey(names ...string) CacheKeyFunc {
+	return func(r *http.Request) string {
+		key := []string{}
+		for _, name := range names {
+			if cookie, err := r.Cookie(name); err == nil {
+				key = append(key, name+"="+cookie.Value)
+			}
+		}
+		return strings.Join(key, ";")
+	}
+}
+
+// CacheKeys returns a CacheKeyFunc that joins the keys of keyFuncs, for example CacheKeys(RequestURIKey, HeaderKey("Accept-Language")). Each page needs a distinct key, so RequestURIKey should be included.
+func CacheKeys(keyFuncs ...CacheKeyFunc) CacheKeyFunc {
+	return func(r *http.Request) string {
+		key := make([]string, len(keyFuncs))
+		for i, keyFunc := range keyFuncs {
+			key[i] = keyFunc(r)
+		}
+		return strings.Join(key, "\n")
+	}
+}
+
+// keyURI returns the request URI of a cache key, which is the first key for keys made by CacheKeys.
+func keyURI(key string) string {
+	if i := strings.IndexByte(key, '\n'); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+// MaxVaryPaths is the maximum number of URL paths for which VaryKey remembers the Vary header.
+var MaxVaryPaths = 1024
+
+// VaryKey is a CacheKeyFunc that returns the request URI and the values of the request headers listed in the Vary header of the last response for the same path. The Vary header of responses is only tracked once VaryKey is used.
+func (p *P) VaryKey(r *http.Request) string {
+	atomic.StoreInt32(&p.varying, 1)
+
+	p.varyMutex.RLock()
+	names := p.vary[r.URL.Path]
+	p.varyMutex.RUnlock()
+
+	if len(names) == 0 {
+		return r.RequestURI
+	}
+	return r.RequestURI + "\n" + headerKey(r, names)
+}
+
+// setVary remembers the request headers in the Vary header of a response for path, it returns true if they have changed. It does nothing if VaryKey is not used.
+func (p *P) setVary(path, vary string) bool {
+	if atomic.LoadInt32(&p.varying) == 0 {
+		return false
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "*" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+
+	p.varyMutex.Lock()
+	defer p.varyMutex.Unlock()
+	prev, ok := p.vary[path]
+	if len(names) == 0 {
+		delete(p.vary, path)
+		return ok
+	} else if strings.Join(prev, ",") == strings.Join(names, ",") {
+		return false
+	}
+	if !ok && len(p.vary) >= MaxVaryPaths {
+		for evict := range p.vary {
+			delete(p.vary, evict)
+			break
+		}
+	}
+	p.vary[path] = names
+	return true
+}
+
+func headerKey(r *http.Request, names []string) string {
+	key := make([]string, len(names))
+	for i, name := range names {
+		key[i] = name + "=" + strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+	}
+	return strings.Join(key, ";")
+}
+
 ////////////////
 
 type DefaultCache struct {
-	uris  map[string][]string
-	mutex sync.RWMutex
+	uris       map[string][]string
+	validators map[string]string
+	mutex      sync.RWMutex
 }
 
 func NewDefaultCache() *DefaultCache {
-	return &DefaultCache{make(map[string][]string), sync.RWMutex{}}
+	return &DefaultCache{make(map[string][]string), make(map[string]string), sync.RWMutex{}}
 }
 
 func (c *DefaultCache) Get(uri string) ([]string, bool) {
@@ -39,9 +169,222 @@ func (c *DefaultCache) Add(uri string, resource string) {
 	c.uris[uri] = append(c.uris[uri], resource)
 }
 
+func (c *DefaultCache) Set(uri string, resources []string) {
+	c.SetValidated(uri, resources, "")
+}
+
 func (c *DefaultCache) Del(uri string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	delete(c.uris, uri)
+	delete(c.validators, uri)
+}
+
+func (c *DefaultCache) GetValidated(uri string) ([]string, string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	resources, ok := c.uris[uri]
+	return resources, c.validators[uri], ok
+}
+
+func (c *DefaultCache) SetValidated(uri string, resources []string, validator string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.uris[uri] = resources
+	if validator != "" {
+		c.validators[uri] = validator
+	} else {
+		delete(c.validators, uri)
+	}
+}
+
+////////////////
+
+type lruEntry struct {
+	uri          string
+	resources    []string
+	validator    string
+	added        time.Time
+	revalidating bool
+}
+
+// LRUCache is a Cache that holds a limited number of entries and resources and evicts the least recently used entries. Entries expire after a TTL.
+type LRUCache struct {
+	maxEntries   int
+	maxResources int
+	ttl          time.Duration
+	stale        time.Duration
+
+	list      *list.List
+	entries   map[string]*list.Element
+	resources int
+	mutex     sync.Mutex
+	now       func() time.Time
+
+	// OnEvict, if not nil, is called with the URI of entries that are evicted or expire. It is called while the cache is locked and must not call the cache.
+	OnEvict func(uri string)
+}
+
+// NewLRUCache returns a new LRUCache. maxEntries and maxResources limit the number of entries and the total number of resources over all entries, ttl is the duration after which an entry expires. Zero values disable the respective limits.
+// If stale is not zero, an expired entry is still returned for the duration of stale after it expired, except for the first Get after expiry which misses to have the entry revalidated.
+func NewLRUCache(maxEntries, maxResources int, ttl, stale time.Duration) *LRUCache {
+	return &LRUCache{maxEntries, maxResources, ttl, stale, list.New(), make(map[string]*list.Element), 0, sync.Mutex{}, time.Now, nil}
+}
+
+func (c *LRUCache) Get(uri string) ([]string, bool) {
+	resources, _, ok := c.GetValidated(uri)
+	return resources, ok
+}
+
+func (c *LRUCache) GetValidated(uri string) ([]string, string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[uri]
+	if !ok {
+		return nil, "", false
+	}
+	entry := elem.Value.(*lruEntry)
+	if c.ttl != 0 {
+		if age := c.now().Sub(entry.added); c.ttl+c.stale <= age {
+			c.remove(elem)
+			c.evicted(uri)
+			return nil, "", false
+		} else if c.ttl <= age && !entry.revalidating {
+			entry.revalidating = true
+			return nil, "", false
+		}
+	}
+	c.list.MoveToFront(elem)
+	return entry.resources, entry.validator, true
+}
+
+func (c *LRUCache) Add(uri string, resource string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[uri]
+	if !ok {
+		elem = c.list.PushFront(&lruEntry{uri, nil, "", c.now(), false})
+		c.entries[uri] = elem
+	} else {
+		c.list.MoveToFront(elem)
+	}
+	entry := elem.Value.(*lruEntry)
+	entry.resources = append(entry.resources, resource)
+	c.resources++
+
+	c.evict()
+}
+
+func (c *LRUCache) Set(uri string, resources []string) {
+	c.SetValidated(uri, resources, "")
+}
+
+func (c *LRUCache) SetValidated(uri string, resources []string, validator string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[uri]; ok {
+		c.remove(elem)
+	}
+	c.entries[uri] = c.list.PushFront(&lruEntry{uri, resources, validator, c.now(), false})
+	c.resources += len(resources)
+	c.evict()
+}
+
+func (c *LRUCache) Del(uri string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[uri]; ok {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of entries and the total number of resources in the cache.
+func (c *LRUCache) Len() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.list.Len(), c.resources
+}
+
+func (c *LRUCache) evict() {
+	for c.list.Len() > 1 && (c.maxEntries != 0 && c.maxEntries < c.list.Len() || c.maxResources != 0 && c.maxResources < c.resources) {
+		c.evicted(c.remove(c.list.Back()))
+	}
+}
+
+func (c *LRUCache) evicted(uri string) {
+	if c.OnEvict != nil {
+		c.OnEvict(uri)
+	}
+}
+
+func (c *LRUCache) remove(elem *list.Element) string {
+	entry := c.list.Remove(elem).(*lruEntry)
+	delete(c.entries, entry.uri)
+	c.resources -= len(entry.resources)
+	return entry.uri
+}
+
+////////////////
+
+// FlightTimeout is the maximum duration a request waits for a concurrent request of the same URI to be parsed. The flight is abandoned afterwards, so that a request that is never closed does not block others.
+var FlightTimeout = 10 * time.Second
+
+// flight is an in-progress parse of an URI that is not cached, concurrent requests for the same URI wait for it to finish.
+type flight struct {
+	done      chan struct{}
+	resources []string
+	ok        bool
+	ended     bool
+}
+
+// startFlight returns the flight in progress for uri and true, or starts a new flight and returns it and false.
+func (p *P) startFlight(uri string) (*flight, bool) {
+	p.flightsMutex.Lock()
+	defer p.flightsMutex.Unlock()
+
+	if f, ok := p.flights[uri]; ok {
+		return f, true
+	}
+	f := &flight{make(chan struct{}), nil, false, false}
+	p.flights[uri] = f
+	return f, false
+}
+
+// endFlight finishes flight f for uri and releases waiting requests. It does nothing when f has already ended.
+func (p *P) endFlight(uri string, f *flight, resources []string, ok bool) {
+	p.flightsMutex.Lock()
+	defer p.flightsMutex.Unlock()
+
+	if f.ended {
+		return
+	}
+	f.resources, f.ok, f.ended = resources, ok, true
+	close(f.done)
+	if p.flights[uri] == f {
+		delete(p.flights, uri)
+	}
+}
+
+// waitFlight waits for flight f for uri to finish and returns its resources. It returns false when the flight failed, when the request is canceled, or after FlightTimeout in which case the flight is abandoned.
+func (p *P) waitFlight(r *http.Request, uri string, f *flight) ([]string, bool) {
+	timer := time.NewTimer(FlightTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.resources, f.ok
+	case <-r.Context().Done():
+		return nil, false
+	case <-timer.C:
+		p.endFlight(uri, f, nil, false)
+		return nil, false
+	}
 }
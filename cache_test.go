@@ -0,0 +1,134 @@
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/test"
+)
+
+func TestDefaultCache(t *testing.T) {
+	c := NewDefaultCache()
+	c.Add("/index.html", "/style.css")
+	c.Add("/index.html", "/script.js")
+
+	resources, ok := c.Get("/index.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/style.css,/script.js")
+
+	c.Del("/index.html")
+	_, ok = c.Get("/index.html")
+	test.That(t, !ok)
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2, 3, 0, 0)
+	c.Add("/a.html", "/a.css")
+	c.Add("/b.html", "/b.css")
+	c.Get("/a.html")
+	c.Add("/c.html", "/c.css") // evicts b
+
+	_, ok := c.Get("/b.html")
+	test.That(t, !ok, "b evicted by max entries")
+	resources, ok := c.Get("/a.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/a.css")
+
+	c.Add("/a.html", "/a.js")
+	c.Add("/a.html", "/a.png") // evicts c
+	_, ok = c.Get("/c.html")
+	test.That(t, !ok, "c evicted by max resources")
+
+	entries, n := c.Len()
+	test.That(t, entries == 1 && n == 3)
+
+	c.Del("/a.html")
+	entries, n = c.Len()
+	test.That(t, entries == 0 && n == 0)
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewLRUCache(0, 0, time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	c.Add("/index.html", "/style.css")
+	_, ok := c.Get("/index.html")
+	test.That(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("/index.html")
+	test.That(t, !ok, "expired")
+	entries, _ := c.Len()
+	test.That(t, entries == 0)
+}
+
+func TestLRUCacheStale(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewLRUCache(0, 0, time.Minute, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Add("/index.html", "/style.css")
+
+	now = now.Add(90 * time.Second)
+	_, ok := c.Get("/index.html")
+	test.That(t, !ok, "first get after expiry revalidates")
+	resources, ok := c.Get("/index.html")
+	test.That(t, ok, "stale while revalidating")
+	test.String(t, strings.Join(resources, ","), "/style.css")
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("/index.html")
+	test.That(t, !ok, "stale expired")
+}
+
+func TestCacheKeys(t *testing.T) {
+	r := httptest.NewRequest("GET", "/index.html?q=1", nil)
+	r.Header.Set("Accept-Language", "nl")
+	r.AddCookie(&http.Cookie{Name: "flag", Value: "on"})
+	r.AddCookie(&http.Cookie{Name: "session", Value: "123"})
+
+	test.String(t, RequestURIKey(r), "/index.html?q=1")
+	test.String(t, HostKey(r), "example.com")
+	test.String(t, HeaderKey("accept-language", "DNT")(r), "accept-language=nl;DNT=")
+	test.String(t, CookieKey("flag")(r), "flag=on")
+	test.String(t, CacheKeys(RequestURIKey, CookieKey("flag"))(r), "/index.html?q=1\nflag=on")
+}
+
+func TestVaryKey(t *testing.T) {
+	cache := NewDefaultCache()
+	p := New("example.com/", nil, cache)
+	p.CacheKey = p.VaryKey
+
+	serve := func(lang string) string {
+		r := httptest.NewRequest("GET", "/index.html", nil)
+		r.Header.Set("Accept-Language", lang)
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, r)
+		test.Error(t, err, nil)
+		pw.Header().Set("Vary", "accept-language")
+		pw.Write([]byte(`<img src="/` + lang + `.png">`))
+		test.Error(t, pw.Close(), nil)
+		return strings.Join(w.URIs, ",")
+	}
+
+	test.String(t, serve("en"), "/en.png")
+	_, ok := cache.Get("/index.html\nAccept-Language=en")
+	test.That(t, ok, "first response is stored under the varied key")
+	_, ok = cache.Get("/index.html")
+	test.That(t, !ok, "no entry under the plain key")
+
+	test.String(t, serve("nl"), "/nl.png")
+	test.String(t, serve("en"), "/en.png")
+
+	resources, ok := cache.Get("/index.html\nAccept-Language=nl")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/nl.png")
+
+	p = New("example.com/", nil, NewDefaultCache())
+	serve("en")
+	test.That(t, len(p.vary) == 0, "Vary is not tracked without VaryKey")
+}
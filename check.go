@@ -0,0 +1,135 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Problem is a broken reference found by Check.
+type Problem struct {
+	ReferenceError
+	Line   int // line of the reference in the referrer, starting at 1, or 0 if unknown
+	Column int // column in bytes, starting at 1, or 0 if unknown
+}
+
+func (p Problem) Error() string {
+	if p.Referrer == "" {
+		return p.Raw + ": " + p.Err.Error()
+	} else if p.Line == 0 {
+		return p.ReferenceError.Error()
+	}
+	return p.Referrer + ":" + strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Column) + ": " + p.Raw + ": " + p.Err.Error()
+}
+
+// Report is the result of Check. Problems are sorted by referrer and position.
+type Report struct {
+	Missing     []Problem // referenced local files that cannot be opened
+	Unparseable []Problem // referenced local files that cannot be parsed
+	Outside     []Problem // references outside the base URL
+}
+
+// All returns the missing, unparseable and outside problems sorted by referrer and position.
+func (r *Report) All() []Problem {
+	problems := append(append(append([]Problem{}, r.Missing...), r.Unparseable...), r.Outside...)
+	sortProblems(problems)
+	return problems
+}
+
+// OK returns true if there are no missing or unparseable files. References outside the base URL are not considered broken.
+func (r *Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unparseable) == 0
+}
+
+// Check parses the pages with uris and all local resources they reference recursively, and reports references to files that cannot be opened or parsed, and references outside baseURL. References for all media and inside <template> and <noscript> elements are checked. Pages that cannot be opened are reported as missing with an empty referrer.
+// Positions are those of the reference as written in the referrer, as reported by the parsers. They are unknown for references that are escaped in the file, such as in <iframe srcdoc="...">, and for the expanded URLs of DASH manifests.
+func Check(baseURL string, opener FileOpener, uris []string) (*Report, error) {
+	c := &checker{opener, map[string][]byte{}, map[string]bool{}, &Report{}, sync.Mutex{}}
+	for _, uri := range uris {
+		r, mimetype, err := c.Open(uri)
+		if err != nil {
+			c.add(&ReferenceError{Resource{URI: uri, pos: -1}, uri, err})
+			continue
+		}
+
+		parser, err := NewParser(baseURL, c, NewListHandler())
+		if err != nil {
+			return nil, err
+		}
+		parser.ErrorHandler = c.add
+		parser.MediaPolicy = nil
+		parser.TemplatePolicy, parser.NoscriptPolicy = TagContext, TagContext
+		if err = parser.Parse(r, mimetype, uri); err != nil && err != ErrNoParser {
+			c.add(&ReferenceError{Resource{URI: uri, pos: -1}, uri, err})
+		}
+	}
+
+	for _, problems := range [][]Problem{c.report.Missing, c.report.Unparseable, c.report.Outside} {
+		sortProblems(problems)
+	}
+	return c.report, nil
+}
+
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Referrer != problems[j].Referrer {
+			return problems[i].Referrer < problems[j].Referrer
+		} else if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+}
+
+type checker struct {
+	opener FileOpener
+	files  map[string][]byte // URI -> contents of opened files
+	failed map[string]bool   // URIs that could not be opened
+	report *Report
+	mutex  sync.Mutex
+}
+
+// Open reads the file from opener and keeps its contents to find the line and column of references.
+func (c *checker) Open(uri string) (io.Reader, string, error) {
+	r, mimetype, err := c.opener.Open(uri)
+	var b []byte
+	if err == nil {
+		b, err = ioutil.ReadAll(r)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil {
+		c.failed[uri] = true
+		return nil, "", err
+	}
+	c.files[uri] = b
+	return bytes.NewReader(b), mimetype, nil
+}
+
+func (c *checker) add(err *ReferenceError) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	problem := Problem{*err, 0, 0}
+	if b, ok := c.files[err.Referrer]; ok && 0 <= err.pos && err.pos <= int64(len(b)) {
+		offset := int(err.pos)
+		problem.Line = 1 + bytes.Count(b[:offset], []byte("\n"))
+		problem.Column = 1 + offset - (bytes.LastIndexByte(b[:offset], '\n') + 1)
+	}
+
+	if err.Err == ErrOutsideBaseURL {
+		c.report.Outside = append(c.report.Outside, problem)
+	} else if c.failed[err.URI] {
+		c.report.Missing = append(c.report.Missing, problem)
+	} else {
+		c.report.Unparseable = append(c.report.Unparseable, problem)
+	}
+}
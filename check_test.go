@@ -0,0 +1,83 @@
+package push
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestCheck(t *testing.T) {
+	files := map[string]string{
+		"/index.html": "<html>\n  <link rel=\"stylesheet\" href=\"style.css\">\n  <img src=\"/missing.png\"><img src=\"/missing.png\">\n  <script src=\"http://cdn.com/lib.js\"></script>\n  <img src=\"/ok.png\"> <a href=\"mailto:a@example.com\">",
+		"/style.css":  "a {\n\tbackground: url(bg.png);\n}",
+		"/ok.png":     "",
+	}
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if content, ok := files[uri]; ok {
+			return strings.NewReader(content), ExtToMimetype[uri[strings.LastIndexByte(uri, '.'):]], nil
+		} else if uri == "/broken.m3u8" {
+			return strings.NewReader(strings.Repeat("a", 100000)), "application/vnd.apple.mpegurl", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	report, err := Check("example.com/", opener, []string{"/index.html", "/gone.html"})
+	test.Error(t, err, nil)
+	test.That(t, !report.OK())
+
+	errs := []string{}
+	for _, problem := range report.Missing {
+		errs = append(errs, problem.Error())
+	}
+	test.String(t, strings.Join(errs, "\n"), "/gone.html: file does not exist\n/index.html:3:13: /missing.png: file does not exist\n/index.html:3:37: /missing.png: file does not exist\n/style.css:2:18: bg.png: file does not exist")
+	test.That(t, report.Missing[1].Element == "img" && report.Missing[1].Attribute == "src", "element and attribute")
+
+	test.That(t, len(report.Outside) == 1, "number of references outside base URL")
+	test.String(t, report.Outside[0].Error(), "/index.html:4:16: http://cdn.com/lib.js: outside base URL")
+	test.That(t, len(report.Unparseable) == 0, "number of unparseable files")
+
+	files["/index.html"] = `<video src="/broken.m3u8">`
+	report, err = Check("example.com/", opener, []string{"/index.html"})
+	test.Error(t, err, nil)
+	test.That(t, len(report.Unparseable) == 1, "number of unparseable files")
+	test.String(t, report.Unparseable[0].Error(), "/index.html:1:13: /broken.m3u8: bufio.Scanner: token too long")
+	test.That(t, report.OK() == false)
+}
+
+func TestCheckPositions(t *testing.T) {
+	files := map[string]string{
+		"/index.html":  "<p>/a.png</p>\n<img srcset=\"/ok.png 1x, /a.png 2x\" style=\"background: url( '/b.png' )\">\n<style>/* url(/c.png) */ p{background:url(/c.png)}</style>\n<template><img src=\"/f.png\"></template><noscript><img src=\"/g.png\"></noscript>",
+		"/style.css":   "@media print{a{background:url(/d.png)}}\n/* url(/d.png) */ a{background:url(/d.png)}\n@import \"/e.css\";",
+		"/stream.m3u8": "#EXTM3U\r\n#EXT-X-MAP:URI=\"/init.mp4\"\r\n  /segment.ts\r\n",
+		"/ok.png":      "",
+	}
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if content, ok := files[uri]; ok {
+			return strings.NewReader(content), ExtToMimetype[uri[strings.LastIndexByte(uri, '.'):]], nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	report, err := Check("", opener, []string{"/index.html", "/style.css", "/stream.m3u8"})
+	test.Error(t, err, nil)
+
+	errs := []string{}
+	for _, problem := range report.All() {
+		errs = append(errs, problem.Error())
+	}
+	test.String(t, strings.Join(errs, "\n"), strings.Join([]string{
+		"/index.html:2:26: /a.png: file does not exist",
+		"/index.html:2:62: /b.png: file does not exist",
+		"/index.html:3:43: /c.png: file does not exist",
+		"/index.html:4:21: /f.png: file does not exist",
+		"/index.html:4:60: /g.png: file does not exist",
+		"/stream.m3u8:2:17: /init.mp4: file does not exist",
+		"/stream.m3u8:3:3: /segment.ts: file does not exist",
+		"/style.css:1:31: /d.png: file does not exist",
+		"/style.css:2:36: /d.png: file does not exist",
+		"/style.css:3:10: /e.css: file does not exist",
+	}, "\n"))
+}
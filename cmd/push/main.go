@@ -0,0 +1,341 @@
+// Command push lists, graphs and checks the resources referenced by a site, as found by the push parsers, and generates push manifests, web server configuration and precache manifests.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tdewolff/push"
+	"github.com/tdewolff/push/serverconfig"
+)
+
+const usage = `Usage: push <command> [flags] <file or directory>
+
+Commands:
+  list      print the resource URIs referenced by each page
+  graph     print the resource graph as JSON or DOT
+  check     print references to missing or unparseable local files and exit
+            with status 1 if any
+  manifest  print the push_manifest.json of the pages
+  config    print nginx, Apache or Caddy configuration that preloads the
+            resources of each page
+  precache  print the Workbox precache manifest of the pages and resources
+
+For a directory, all HTML files in it are parsed as pages and the directory is
+the web root. For a file, its directory is the web root.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = list(os.Args[2:])
+	case "graph":
+		err = graph(os.Args[2:])
+	case "check":
+		err = check(os.Args[2:])
+	case "manifest":
+		err = manifest(os.Args[2:])
+	case "config":
+		err = config(os.Args[2:])
+	case "precache":
+		err = precache(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "push: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "push:", err)
+		os.Exit(2)
+	}
+}
+
+func sriFlag(fs *flag.FlagSet) *string {
+	return fs.String("sri", "", "compute Subresource Integrity hashes of scripts and stylesheets, sha256, sha384 or sha512")
+}
+
+func validSRI(algorithm string) bool {
+	_, err := push.Integrity(strings.NewReader(""), algorithm)
+	return algorithm == "" || err == nil
+}
+
+func flags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: push %s [flags] <file or directory>\n", name)
+		fs.PrintDefaults()
+	}
+	baseURL := fs.String("base", "", "base URL that local resources must have, e.g. example.com/; if it has no host, URLs with a host are external")
+	return fs, baseURL
+}
+
+// localHost is the host of the base URL when none is given, so that URLs with a host, such as those of a CDN, are not taken for local resources.
+const localHost = "local.invalid"
+
+// parseFlags parses the flags and adds localHost to a base URL without host.
+func parseFlags(fs *flag.FlagSet, args []string, baseURL *string) {
+	fs.Parse(args)
+	if *baseURL == "" {
+		*baseURL = "//" + localHost + "/"
+	} else if strings.HasPrefix(*baseURL, "/") && !strings.HasPrefix(*baseURL, "//") {
+		*baseURL = "//" + localHost + *baseURL
+	}
+}
+
+func list(args []string) error {
+	fs, baseURL := flags("list")
+	sri := sriFlag(fs)
+	parseFlags(fs, args, baseURL)
+	if fs.NArg() != 1 || !validSRI(*sri) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, page := range s.pages {
+		r, mimetype, err := s.Open(page)
+		if err != nil {
+			return err
+		}
+		h := push.NewListHandler()
+		parser, err := push.NewParser(*baseURL, s, h)
+		if err != nil {
+			return err
+		}
+		parser.MediaPolicy = nil
+		if err = parser.Parse(r, mimetype, page); err != nil {
+			return fmt.Errorf("%s: %v", page, err)
+		}
+		uris := h.URIs
+		indent := ""
+		if len(s.pages) > 1 {
+			fmt.Println(page)
+			indent = "\t"
+		}
+		for _, uri := range uris {
+			if integrity := s.integrity(uri, *sri); integrity != "" {
+				fmt.Println(indent + uri + " " + integrity)
+			} else {
+				fmt.Println(indent + uri)
+			}
+		}
+	}
+	return nil
+}
+
+func graph(args []string) error {
+	fs, baseURL := flags("graph")
+	format := fs.String("format", "json", "output format, json or dot")
+	sri := sriFlag(fs)
+	parseFlags(fs, args, baseURL)
+	if fs.NArg() != 1 || *format != "json" && *format != "dot" || !validSRI(*sri) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	g, err := s.graph(*baseURL, *sri)
+	if err != nil {
+		return err
+	}
+	if *format == "dot" {
+		return g.WriteDOT(os.Stdout)
+	}
+	return g.WriteJSON(os.Stdout)
+}
+
+func check(args []string) error {
+	fs, baseURL := flags("check")
+	outside := fs.Bool("outside", false, "also print references outside the base URL")
+	parseFlags(fs, args, baseURL)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	report, err := push.Check(*baseURL, s, s.pages)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.All() {
+		if *outside || problem.Err != push.ErrOutsideBaseURL {
+			fmt.Println(problem.Error())
+		}
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func manifest(args []string) error {
+	fs, baseURL := flags("manifest")
+	parseFlags(fs, args, baseURL)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := push.NewPushManifest(*baseURL, s, s.pages)
+	if err != nil {
+		return err
+	}
+	return m.Write(os.Stdout)
+}
+
+func config(args []string) error {
+	fs, baseURL := flags("config")
+	server := fs.String("server", "nginx", "web server, nginx, apache or caddy")
+	parseFlags(fs, args, baseURL)
+	generate, ok := map[string]func(io.Writer, push.PushManifest) error{
+		"nginx":  serverconfig.Nginx,
+		"apache": serverconfig.Apache,
+		"caddy":  serverconfig.Caddy,
+	}[*server]
+	if fs.NArg() != 1 || !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := push.NewPushManifest(*baseURL, s, s.pages)
+	if err != nil {
+		return err
+	}
+	return generate(os.Stdout, m)
+}
+
+func precache(args []string) error {
+	fs, baseURL := flags("precache")
+	maxSize := fs.Int64("max-size", 2*1024*1024, "skip files larger than this number of bytes, 0 for no limit")
+	module := fs.Bool("module", false, "print a JavaScript module instead of JSON")
+	parseFlags(fs, args, baseURL)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openSite(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := push.NewPrecacheManifest(*baseURL, s, s.pages, *maxSize)
+	if err != nil {
+		return err
+	}
+	if *module {
+		return m.WriteModule(os.Stdout)
+	}
+	return m.WriteJSON(os.Stdout)
+}
+
+////////////////
+
+// site is a FileOpener for a web root directory. It reads files into memory so that no files are left open while parsing many pages.
+type site struct {
+	root  string
+	pages []string // URIs of the pages to parse
+}
+
+// openSite returns the site of a file or of all HTML files in a directory.
+func openSite(name string) (*site, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return &site{filepath.Dir(name), []string{"/" + filepath.Base(name)}}, nil
+	}
+
+	s := &site{name, []string{}}
+	err = filepath.Walk(name, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (filepath.Ext(filename) == ".html" || filepath.Ext(filename) == ".htm") {
+			rel, err := filepath.Rel(name, filename)
+			if err != nil {
+				return err
+			}
+			s.pages = append(s.pages, "/"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(s.pages)
+	return s, err
+}
+
+func (s *site) Open(uri string) (io.Reader, string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+uri))))
+	if err != nil {
+		return nil, "", err
+	}
+	mimetype := push.ExtToMimetype[path.Ext(uri)]
+	if path.Ext(uri) == ".htm" {
+		mimetype = "text/html"
+	}
+	return bytes.NewReader(b), mimetype, nil
+}
+
+// integrity returns the Subresource Integrity metadata of scripts and stylesheets, or an empty string otherwise.
+func (s *site) integrity(uri, algorithm string) string {
+	if kind := push.ResourceKind(push.Resource{URI: uri}); algorithm == "" || kind != push.ScriptKind && kind != push.StyleKind {
+		return ""
+	}
+	r, _, err := s.Open(uri)
+	if err != nil {
+		return ""
+	}
+	integrity, _ := push.Integrity(r, algorithm)
+	return integrity
+}
+
+// graph returns the combined resource graph of all pages, with the Subresource Integrity metadata computed with algorithm if not empty.
+func (s *site) graph(baseURL, algorithm string) (*push.Graph, error) {
+	g := push.NewGraph()
+	g.Integrity = algorithm
+	for _, page := range s.pages {
+		r, mimetype, err := s.Open(page)
+		if err != nil {
+			return nil, err
+		}
+		if err = g.Parse(baseURL, s, r, mimetype, page); err != nil {
+			return nil, fmt.Errorf("%s: %v", page, err)
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,413 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDigest is returned when a digest cannot be decoded.
+var ErrDigest = errors.New("invalid digest")
+
+// Digest is a Golomb-coded set of keys, encoded as the digest-value of cache digests (draft-ietf-httpbis-cache-digest). Keys are hashed with SHA-256 and truncated to log2(N*P) bits, for a set of at most N keys with a false positive probability of 1/P.
+type Digest struct {
+	logN, logP uint
+	values     []uint64 // sorted hash values
+}
+
+// NewDigest returns an empty Digest for N = 2^logN keys and a false positive probability of 1/2^logP. logN and logP must be smaller than 32, and logN at most MaxDigestLogN for the digest to be decoded by ParseDigest.
+func NewDigest(logN, logP uint) *Digest {
+	return &Digest{logN, logP, []uint64{}}
+}
+
+// MaxDigestLogN is the maximum log2(N) of digests decoded by ParseDigest, which bounds the memory used to decode the digests sent by clients.
+const MaxDigestLogN = 16
+
+// ParseDigest decodes a digest-value. It returns ErrDigest if log2(N) is larger than MaxDigestLogN or if the digest holds more than N values.
+func ParseDigest(b []byte) (*Digest, error) {
+	logN, logP, err := digestParameters(b)
+	if err != nil {
+		return nil, err
+	}
+	return parseDigestValues(b, logN, logP)
+}
+
+// digestParameters returns log2(N) and log2(P) of a digest-value without decoding its values.
+func digestParameters(b []byte) (uint, uint, error) {
+	r := &bitReader{b, 0}
+	logN, ok := r.read(5)
+	if !ok {
+		return 0, 0, ErrDigest
+	}
+	logP, ok := r.read(5)
+	if !ok {
+		return 0, 0, ErrDigest
+	} else if logN > MaxDigestLogN {
+		return 0, 0, ErrDigest
+	}
+	return uint(logN), uint(logP), nil
+}
+
+// parseDigestValues decodes the values of a digest-value of which the parameters are checked by digestParameters.
+func parseDigestValues(b []byte, logN, logP uint) (*Digest, error) {
+	r := &bitReader{b, 10}
+	d := NewDigest(logN, logP)
+
+	c := int64(-1)
+	for {
+		// unary encoded quotient, the padding of the last byte has no terminating one bit
+		q := uint64(0)
+		for {
+			bit, ok := r.read(1)
+			if !ok {
+				return d, nil
+			} else if bit == 1 {
+				break
+			}
+			q++
+		}
+		rem, ok := r.read(d.logP)
+		if !ok {
+			return nil, ErrDigest
+		}
+		if uint64(len(d.values)) >= 1<<d.logN {
+			return nil, ErrDigest
+		}
+		v := uint64(c+1) + q<<d.logP + rem
+		d.values = append(d.values, v)
+		c = int64(v)
+	}
+}
+
+// Len returns the number of distinct hash values in the digest.
+func (d *Digest) Len() int {
+	return len(d.values)
+}
+
+// Add adds key to the digest.
+func (d *Digest) Add(key string) {
+	v := d.hash(key)
+	i := sort.Search(len(d.values), func(i int) bool { return d.values[i] >= v })
+	if i < len(d.values) && d.values[i] == v {
+		return
+	}
+	d.values = append(d.values, 0)
+	copy(d.values[i+1:], d.values[i:])
+	d.values[i] = v
+}
+
+// Contains returns true if key is probably in the digest.
+func (d *Digest) Contains(key string) bool {
+	v := d.hash(key)
+	i := sort.Search(len(d.values), func(i int) bool { return d.values[i] >= v })
+	return i < len(d.values) && d.values[i] == v
+}
+
+// Bytes returns the encoded digest-value.
+func (d *Digest) Bytes() []byte {
+	w := &bitWriter{}
+	w.write(uint64(d.logN), 5)
+	w.write(uint64(d.logP), 5)
+	c := int64(-1)
+	for _, v := range d.values {
+		delta := v - uint64(c+1)
+		for q := delta >> d.logP; q > 0; q-- {
+			w.write(0, 1)
+		}
+		w.write(1, 1)
+		w.write(delta, d.logP)
+		c = int64(v)
+	}
+	return w.b
+}
+
+// hash returns the first log2(N*P) bits of the SHA-256 hash of key.
+func (d *Digest) hash(key string) uint64 {
+	h := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(h[:8]) >> (64 - d.logN - d.logP)
+}
+
+type bitReader struct {
+	b   []byte
+	pos uint // position in bits
+}
+
+// read reads n bits as big-endian integer, it returns false if there are not enough bits left.
+func (r *bitReader) read(n uint) (uint64, bool) {
+	if r.pos+n > uint(len(r.b))*8 {
+		return 0, false
+	}
+	v := uint64(0)
+	for i := uint(0); i < n; i++ {
+		bit := r.b[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v, true
+}
+
+type bitWriter struct {
+	b   []byte
+	pos uint // position in bits
+}
+
+// write writes the lower n bits of v, the last byte is padded with zero bits.
+func (w *bitWriter) write(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		if w.pos%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[w.pos/8] |= byte(v>>(i-1)&1) << (7 - w.pos%8)
+		w.pos++
+	}
+}
+
+////////////////
+
+const (
+	cookieDigestLogN = 6 // at most 64 resources, after which the digest is reset
+	cookieDigestLogP = 7 // false positive probability of 1/128
+)
+
+// DigestCookieMaxAge is the lifetime of the digest cookie.
+var DigestCookieMaxAge = 30 * 24 * time.Hour
+
+// cookieDigest is the digest of resources pushed to a client, which is read from and written to a cookie. Keys are the URI followed by the version of the resource, so that changed resources are pushed again.
+type cookieDigest struct {
+	name    string
+	infos   *resourceInfos
+	digest  *Digest
+	keys    map[string]string // URI -> key
+	changed bool
+	mutex   sync.Mutex
+}
+
+// cookieDigest returns the digest of the cookie of the request, or an empty digest if it is not set, is invalid or has other parameters.
+func (p *P) cookieDigest(r *http.Request) *cookieDigest {
+	c := &cookieDigest{p.DigestCookie, p.infos, nil, map[string]string{}, false, sync.Mutex{}}
+	if cookie, err := r.Cookie(p.DigestCookie); err == nil {
+		if b, err := base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			if logN, logP, err := digestParameters(b); err == nil && logN == cookieDigestLogN && logP == cookieDigestLogP {
+				if digest, err := parseDigestValues(b, logN, logP); err == nil {
+					c.digest = digest
+				}
+			}
+		}
+	}
+	if c.digest == nil {
+		c.digest = NewDigest(cookieDigestLogN, cookieDigestLogP)
+	}
+	return c
+}
+
+// key returns the URI followed by the version of the resource.
+func (c *cookieDigest) key(uri string) string {
+	if key, ok := c.keys[uri]; ok {
+		return key
+	}
+	key := uri + c.infos.version(uri)
+	c.keys[uri] = key
+	return key
+}
+
+func (c *cookieDigest) contains(uri string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.digest.Contains(c.key(uri))
+}
+
+func (c *cookieDigest) add(uri string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.digest.Len() >= 1<<cookieDigestLogN {
+		c.digest = NewDigest(cookieDigestLogN, cookieDigestLogP)
+	}
+	c.digest.Add(c.key(uri))
+	c.changed = true
+}
+
+// cookie returns the cookie that stores the digest, or nil if it is unchanged.
+func (c *cookieDigest) cookie() *http.Cookie {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.changed {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     c.name,
+		Value:    base64.RawURLEncoding.EncodeToString(c.digest.Bytes()),
+		Path:     "/",
+		MaxAge:   int(DigestCookieMaxAge / time.Second),
+		HttpOnly: true,
+	}
+}
+
+// digestFilter skips the resources that the client has according to a digest.
+type digestFilter struct {
+	contains func(uri string) bool
+	next     URIHandler
+}
+
+func (h *digestFilter) URI(uri string) error {
+	if h.contains(uri) {
+		return nil
+	}
+	return h.next.URI(uri)
+}
+
+func (h *digestFilter) Resource(res Resource) error {
+	if h.contains(res.URI) {
+		return nil
+	} else if next, ok := h.next.(ResourceHandler); ok {
+		return next.Resource(res)
+	}
+	return h.next.URI(res.URI)
+}
+
+// digestRecorder adds the pushed resources to the digest.
+type digestRecorder struct {
+	digest *cookieDigest
+	next   URIHandler
+}
+
+func (h *digestRecorder) URI(uri string) error {
+	if err := h.next.URI(uri); err != nil {
+		return err
+	}
+	h.digest.add(uri)
+	return nil
+}
+
+// digestResponseWriter sets the digest cookie when the header is written.
+type digestResponseWriter struct {
+	http.ResponseWriter
+
+	digest      *cookieDigest
+	wroteHeader bool
+}
+
+func (w *digestResponseWriter) WriteHeader(code int) {
+	w.setCookie()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *digestResponseWriter) Write(b []byte) (int, error) {
+	w.setCookie()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *digestResponseWriter) setCookie() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if cookie := w.digest.cookie(); cookie != nil {
+		http.SetCookie(w.ResponseWriter, cookie)
+	}
+}
+
+////////////////
+
+// CacheDigest is a digest of the Cache-Digest request header (draft-ietf-httpbis-cache-digest) of the responses that a client has cached. Keys are absolute URLs, followed by the ETag when Validators is set.
+type CacheDigest struct {
+	*Digest
+	Reset      bool // the client has no other cached responses than in this and the other digests
+	Complete   bool // the digest contains all cached responses of the origin
+	Validators bool // keys include the ETag of the response
+	Stale      bool // the cached responses are stale, otherwise they are fresh
+}
+
+// MaxCacheDigests is the maximum number of digests in a Cache-Digest header.
+const MaxCacheDigests = 8
+
+// ParseCacheDigest parses the value of a Cache-Digest header, a comma-separated list of base64url encoded digests with flags separated by semicolons. It returns ErrDigest if the header holds more than MaxCacheDigests digests, the digests are bounded as by ParseDigest.
+func ParseCacheDigest(header string) ([]CacheDigest, error) {
+	items := strings.SplitN(header, ",", MaxCacheDigests+1)
+	if len(items) > MaxCacheDigests {
+		return nil, ErrDigest
+	}
+
+	digests := []CacheDigest{}
+	for _, item := range items {
+		params := strings.Split(item, ";")
+		value := strings.TrimRight(strings.TrimSpace(params[0]), "=")
+		if value == "" {
+			continue
+		}
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, ErrDigest
+		}
+		digest, err := ParseDigest(b)
+		if err != nil {
+			return nil, err
+		}
+
+		cacheDigest := CacheDigest{Digest: digest}
+		for _, flag := range params[1:] {
+			switch strings.ToLower(strings.TrimSpace(flag)) {
+			case "reset":
+				cacheDigest.Reset = true
+			case "complete":
+				cacheDigest.Complete = true
+			case "validators":
+				cacheDigest.Validators = true
+			case "stale":
+				cacheDigest.Stale = true
+			}
+		}
+		digests = append(digests, cacheDigest)
+	}
+	return digests, nil
+}
+
+// cacheDigestContains returns a function that reports whether a resource of the request is in the fresh or stale digests of its Cache-Digest header, or nil if there are none. The scheme and host of the base URL are used when set, since the request may have been forwarded by a proxy. Digests with validators are ignored as the ETags of resources are not known.
+func (p *P) cacheDigestContains(r *http.Request) func(uri string) bool {
+	header := r.Header.Get("Cache-Digest")
+	if header == "" {
+		return nil
+	}
+	digests, err := ParseCacheDigest(header)
+	if err != nil {
+		return nil
+	}
+	keyed := []*Digest{}
+	for _, digest := range digests {
+		if !digest.Validators {
+			keyed = append(keyed, digest.Digest)
+		}
+	}
+	if len(keyed) == 0 {
+		return nil
+	}
+
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if baseURL, err := url.Parse(p.baseURL); err == nil {
+		if baseURL.Scheme != "" {
+			scheme = baseURL.Scheme
+		}
+		if baseURL.Host != "" {
+			host = baseURL.Host
+		}
+	}
+	origin := scheme + "://" + host
+
+	return func(uri string) bool {
+		for _, digest := range keyed {
+			if digest.Contains(origin + uri) {
+				return true
+			}
+		}
+		return false
+	}
+}
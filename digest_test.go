@@ -0,0 +1,195 @@
+package push
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/test"
+)
+
+func TestDigest(t *testing.T) {
+	d := NewDigest(4, 8)
+	for i := 0; i < 10; i++ {
+		d.Add("/" + strconv.Itoa(i) + ".png")
+	}
+	d.Add("/0.png")
+	test.That(t, d.Len() == 10, "ten distinct keys")
+
+	b := d.Bytes()
+	test.That(t, b[0]>>3 == 4, "log2(N) in the first five bits")
+
+	d2, err := ParseDigest(b)
+	test.Error(t, err, nil)
+	test.That(t, d2.Len() == 10, "ten keys after decoding")
+	test.Bytes(t, d2.Bytes(), b)
+	for i := 0; i < 10; i++ {
+		test.That(t, d2.Contains("/"+strconv.Itoa(i)+".png"), "contains", i)
+	}
+	test.That(t, !d2.Contains("/style.css"), "does not contain /style.css")
+
+	_, err = ParseDigest([]byte{0x20})
+	test.Error(t, err, ErrDigest)
+	_, err = ParseDigest([]byte{0x22, 0x20})
+	test.Error(t, err, ErrDigest, "truncated remainder")
+
+	empty, err := ParseDigest(NewDigest(0, 0).Bytes())
+	test.Error(t, err, nil)
+	test.That(t, empty.Len() == 0, "empty digest")
+
+	_, err = ParseDigest(NewDigest(MaxDigestLogN+1, 7).Bytes())
+	test.Error(t, err, ErrDigest, "too many keys")
+	_, err = ParseDigest([]byte{0x00, 0x3f, 0xff})
+	test.Error(t, err, ErrDigest, "more than N values")
+}
+
+func TestResponseWriterDigestCookie(t *testing.T) {
+	style := "a{}"
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if uri == "/style.css" {
+			return strings.NewReader(style), "text/css", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	p := New("", opener, nil)
+	p.Manifest = PushManifest{"/": {"/style.css": {"style", 1}}}
+	p.DigestCookie = "push"
+
+	cookie := ""
+	request := func() string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		w := &pushResponseWriter{rec, NewListHandler()}
+		pw, err := p.ResponseWriter(w, r)
+		test.Error(t, err, nil)
+		pw.Write([]byte(`<p>`))
+		test.Error(t, pw.Close(), nil)
+		if setCookie := rec.Header().Get("Set-Cookie"); setCookie != "" {
+			cookie = setCookie[:strings.IndexByte(setCookie, ';')]
+		}
+		return strings.Join(w.URIs, ",")
+	}
+
+	test.String(t, request(), "/style.css", "first visit")
+	test.That(t, strings.HasPrefix(cookie, "push="), "cookie is set")
+	test.String(t, request(), "", "repeat visit")
+
+	style = "a{color:red}"
+	test.String(t, request(), "", "version is cached for ResourceInfoTTL")
+	now := time.Now().Add(ResourceInfoTTL)
+	p.infos.now = func() time.Time { return now }
+	test.String(t, request(), "/style.css", "changed resource")
+	test.String(t, request(), "", "repeat visit after change")
+}
+
+func TestMiddlewareDigestCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"index.html": `<link rel="stylesheet" href="/style.css"><img src="/logo.png">`,
+		"style.css":  `@font-face{src:url(/font.woff2)}`,
+		"logo.png":   "png",
+		"font.woff2": "woff2",
+	}
+	for name, content := range files {
+		test.Error(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), nil)
+	}
+
+	p := New("", NewDefaultFileOpener(dir), NewDefaultCache())
+	p.DigestCookie = "push"
+	handler := p.Middleware(http.FileServer(http.Dir(dir)))
+
+	cookie := ""
+	request := func() []string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		w := &pushResponseWriter{rec, NewListHandler()}
+		handler.ServeHTTP(w, r)
+		test.That(t, rec.Code == http.StatusOK, "status code")
+		test.String(t, rec.Body.String(), files["index.html"])
+		if setCookie := rec.Header().Get("Set-Cookie"); setCookie != "" {
+			cookie = setCookie[:strings.IndexByte(setCookie, ';')]
+		}
+		sort.Strings(w.URIs)
+		return w.URIs
+	}
+
+	// resources found while parsing are pushed after the header is written, they are not recorded in the cookie
+	test.String(t, strings.Join(request(), ","), "/font.woff2,/logo.png,/style.css", "first visit")
+	test.String(t, cookie, "", "cookie is not set")
+	test.String(t, strings.Join(request(), ","), "/font.woff2,/logo.png,/style.css", "cached resources")
+	test.That(t, strings.HasPrefix(cookie, "push="), "cookie is set")
+	test.String(t, strings.Join(request(), ","), "", "repeat visit")
+}
+
+func TestParseCacheDigest(t *testing.T) {
+	d := NewDigest(2, 5)
+	d.Add("https://example.com/style.css")
+	value := base64.URLEncoding.EncodeToString(d.Bytes())
+
+	digests, err := ParseCacheDigest(value + "; complete ;STALE, " + value + ";validators;reset")
+	test.Error(t, err, nil)
+	test.That(t, len(digests) == 2, "two digests")
+	test.That(t, digests[0].Complete && digests[0].Stale && !digests[0].Validators && !digests[0].Reset, "flags of first digest")
+	test.That(t, digests[1].Validators && digests[1].Reset && !digests[1].Complete && !digests[1].Stale, "flags of second digest")
+	test.That(t, digests[0].Contains("https://example.com/style.css"), "contains style.css")
+
+	_, err = ParseCacheDigest("!!")
+	test.Error(t, err, ErrDigest)
+	_, err = ParseCacheDigest(strings.Repeat(value+",", MaxCacheDigests) + value)
+	test.Error(t, err, ErrDigest, "too many digests")
+}
+
+func TestResponseWriterCacheDigest(t *testing.T) {
+	fresh := NewDigest(1, 7)
+	fresh.Add("http://example.com/style.css")
+	stale := NewDigest(0, 7)
+	stale.Add("http://example.com/app.js")
+	validators := NewDigest(0, 7)
+	validators.Add(`http://example.com/font.woff2"etag"`)
+	header := base64.RawURLEncoding.EncodeToString(fresh.Bytes()) + ", " + base64.RawURLEncoding.EncodeToString(stale.Bytes()) + ";stale, " + base64.RawURLEncoding.EncodeToString(validators.Bytes()) + ";validators"
+
+	p := New("", nil, nil)
+	p.Manifest = PushManifest{"/": {"/style.css": {"style", 1}, "/app.js": {"script", 1}, "/font.woff2": {"font", 1}}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cache-Digest", header)
+	w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err := p.ResponseWriter(w, r)
+	test.Error(t, err, nil)
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/font.woff2", "digests with validators are ignored")
+
+	// the origin is that of the base URL behind a TLS proxy
+	p = New("https://example.com/", nil, nil)
+	p.Manifest = PushManifest{"/": {"/style.css": {"style", 1}, "/app.js": {"script", 1}}}
+	fresh = NewDigest(0, 7)
+	fresh.Add("https://example.com/style.css")
+	header = base64.RawURLEncoding.EncodeToString(fresh.Bytes())
+
+	r = httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Cache-Digest", header)
+	w = &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err = p.ResponseWriter(w, r)
+	test.Error(t, err, nil)
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/app.js")
+}
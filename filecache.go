@@ -0,0 +1,165 @@
+package push
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type fileCacheEntry struct {
+	URI       string   `json:"uri"`
+	Resources []string `json:"resources"`
+	Validator string   `json:"validator,omitempty"`
+}
+
+// FileCacheDelay is the time that FileCache waits after a change before writing the file, so that changes in quick succession are written at once.
+var FileCacheDelay = time.Second
+
+// FileCache is a Cache that is persisted to a file so that it survives restarts. Entries are stored as one JSON object per line, and changes are written FileCacheDelay after the first change by atomically replacing the file. Close must be called to write the remaining changes.
+type FileCache struct {
+	*DefaultCache
+	filename string
+
+	dirty     bool
+	timer     *time.Timer
+	err       error
+	saveMutex sync.Mutex
+}
+
+// NewFileCache returns a new FileCache that loads its entries from filename if it exists. Lines that cannot be decoded are discarded.
+func NewFileCache(filename string) (*FileCache, error) {
+	c := &FileCache{NewDefaultCache(), filename, false, nil, nil, sync.Mutex{}}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := fileCacheEntry{}
+			if json.Unmarshal(line, &entry) == nil && entry.URI != "" {
+				c.DefaultCache.SetValidated(entry.URI, entry.Resources, entry.Validator)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Err returns the error of the last write to the file, or nil.
+func (c *FileCache) Err() error {
+	c.saveMutex.Lock()
+	defer c.saveMutex.Unlock()
+
+	return c.err
+}
+
+func (c *FileCache) Add(uri string, resource string) {
+	c.DefaultCache.Add(uri, resource)
+	c.changed()
+}
+
+func (c *FileCache) Set(uri string, resources []string) {
+	c.DefaultCache.Set(uri, resources)
+	c.changed()
+}
+
+func (c *FileCache) SetValidated(uri string, resources []string, validator string) {
+	c.DefaultCache.SetValidated(uri, resources, validator)
+	c.changed()
+}
+
+func (c *FileCache) Del(uri string) {
+	c.DefaultCache.Del(uri)
+	c.changed()
+}
+
+// Flush writes the pending changes to the file and returns the error of the last write.
+func (c *FileCache) Flush() error {
+	c.saveMutex.Lock()
+	defer c.saveMutex.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.dirty {
+		c.dirty = false
+		c.save()
+	}
+	return c.err
+}
+
+// Close writes the pending changes to the file.
+func (c *FileCache) Close() error {
+	return c.Flush()
+}
+
+// changed schedules a write of the file, if none is pending.
+func (c *FileCache) changed() {
+	c.saveMutex.Lock()
+	defer c.saveMutex.Unlock()
+
+	c.dirty = true
+	if c.timer == nil {
+		c.timer = time.AfterFunc(FileCacheDelay, func() {
+			c.Flush()
+		})
+	}
+}
+
+// save writes all entries to the file, saveMutex must be held.
+func (c *FileCache) save() {
+	c.DefaultCache.mutex.RLock()
+	entries := make([]fileCacheEntry, 0, len(c.DefaultCache.uris))
+	for uri, resources := range c.DefaultCache.uris {
+		entries = append(entries, fileCacheEntry{uri, resources, c.DefaultCache.validators[uri]})
+	}
+	c.DefaultCache.mutex.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].URI < entries[j].URI })
+
+	f, err := ioutil.TempFile(filepath.Dir(c.filename), filepath.Base(c.filename)+".tmp")
+	if err != nil {
+		c.err = err
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	c.err = err
+}
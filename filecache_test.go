@@ -0,0 +1,97 @@
+package push
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/test"
+)
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.json")
+
+	c, err := NewFileCache(filename)
+	test.Error(t, err, nil)
+	c.Set("/index.html", []string{"/style.css", "/script.js"})
+	c.SetValidated("/about.html", []string{"/about.png"}, `"etag"`)
+	c.Set("/old.html", []string{"/old.png"})
+	c.Del("/old.html")
+	test.Error(t, c.Close(), nil)
+
+	c, err = NewFileCache(filename)
+	test.Error(t, err, nil)
+	resources, ok := c.Get("/index.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/style.css,/script.js")
+	resources, validator, ok := c.GetValidated("/about.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/about.png")
+	test.String(t, validator, `"etag"`)
+	_, ok = c.Get("/old.html")
+	test.That(t, !ok)
+}
+
+func TestFileCacheDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.json")
+
+	delay := FileCacheDelay
+	FileCacheDelay = time.Hour
+	defer func() { FileCacheDelay = delay }()
+
+	c, err := NewFileCache(filename)
+	test.Error(t, err, nil)
+	c.Set("/index.html", []string{"/style.css"})
+	_, err = os.Stat(filename)
+	test.That(t, os.IsNotExist(err), "changes are not written immediately")
+	test.Error(t, c.Flush(), nil)
+	c2, err := NewFileCache(filename)
+	test.Error(t, err, nil)
+	_, ok := c2.Get("/index.html")
+	test.That(t, ok, "changes are written by Flush")
+
+	// the timer of the next change uses the current delay
+	FileCacheDelay = 10 * time.Millisecond
+	c.Set("/about.html", []string{"/about.png"})
+	ok = false
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		c2, err = NewFileCache(filename)
+		test.Error(t, err, nil)
+		_, ok = c2.Get("/about.html")
+	}
+	test.That(t, ok, "changes are written after the delay")
+	test.Error(t, c.Err(), nil)
+}
+
+func TestFileCacheCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.json")
+
+	content := `{"uri":"/index.html","resources":["/style.css"]}
+{"uri":"/broken.html","resour
+garbage
+{"resources":["/no-uri.css"]}
+{"uri":"/about.html","resources":["/about.png"]}`
+	test.Error(t, ioutil.WriteFile(filename, []byte(content), 0644), nil)
+
+	c, err := NewFileCache(filename)
+	test.Error(t, err, nil)
+	_, ok := c.Get("/index.html")
+	test.That(t, ok)
+	_, ok = c.Get("/about.html")
+	test.That(t, ok)
+	_, ok = c.Get("/broken.html")
+	test.That(t, !ok)
+}
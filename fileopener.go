@@ -2,8 +2,10 @@ package push
 
 import (
 	"io"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 )
 
 // FileOpener is an interface that allows the parser to load embedded resources recursively.
@@ -34,3 +36,14 @@ func (o *DefaultFileOpener) Open(uri string) (io.Reader, string, error) {
 	}
 	return r, ExtToMimetype[path.Ext(uri)], nil
 }
+
+// pageFile returns the file URI that serves the request URI, which is index.html for directories.
+func pageFile(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		uri = u.Path
+	}
+	if strings.HasSuffix(uri, "/") {
+		uri += "index.html"
+	}
+	return uri
+}
@@ -0,0 +1,522 @@
+package push
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrCycle is returned when the resource graph has a cycle and cannot be ordered topologically.
+var ErrCycle = errors.New("resource graph has a cycle")
+
+// Kind is the kind of resource that an edge references.
+type Kind int
+
+// Kind values.
+const (
+	OtherKind Kind = iota
+	DocumentKind
+	StyleKind
+	ScriptKind
+	ImageKind
+	FontKind
+	MediaKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case DocumentKind:
+		return "document"
+	case StyleKind:
+		return "style"
+	case ScriptKind:
+		return "script"
+	case ImageKind:
+		return "image"
+	case FontKind:
+		return "font"
+	case MediaKind:
+		return "media"
+	}
+	return "other"
+}
+
+var extToKind = map[string]Kind{
+	".html":  DocumentKind,
+	".htm":   DocumentKind,
+	".css":   StyleKind,
+	".js":    ScriptKind,
+	".mjs":   ScriptKind,
+	".png":   ImageKind,
+	".jpg":   ImageKind,
+	".jpeg":  ImageKind,
+	".gif":   ImageKind,
+	".webp":  ImageKind,
+	".avif":  ImageKind,
+	".svg":   ImageKind,
+	".ico":   ImageKind,
+	".woff":  FontKind,
+	".woff2": FontKind,
+	".ttf":   FontKind,
+	".otf":   FontKind,
+	".eot":   FontKind,
+	".m3u8":  MediaKind,
+	".mpd":   MediaKind,
+	".mp4":   MediaKind,
+	".m4s":   MediaKind,
+	".m4a":   MediaKind,
+	".m4v":   MediaKind,
+	".ts":    MediaKind,
+	".webm":  MediaKind,
+	".ogg":   MediaKind,
+	".mp3":   MediaKind,
+	".vtt":   MediaKind,
+}
+
+// ResourceKind returns the kind of a resource by the extension of its URI, or else by the element and attribute that reference it.
+func ResourceKind(res Resource) Kind {
+	if kind, ok := extToKind[path.Ext(res.URI)]; ok {
+		return kind
+	}
+	switch res.Element {
+	case "":
+		if res.Attribute == "@import" {
+			return StyleKind
+		} else if res.Attribute == "src" {
+			return FontKind // @font-face
+		}
+		return ImageKind
+	case "iframe", "frame", "object", "embed":
+		return DocumentKind
+	case "script":
+		return ScriptKind
+	case "img", "image", "picture", "input", "svg", "feImage":
+		return ImageKind
+	case "video", "audio", "source", "track", "EXTINF", "EXT-X-STREAM-INF", "EXT-X-MAP", "EXT-X-MEDIA", "Initialization", "SegmentURL", "SegmentTemplate":
+		return MediaKind
+	}
+	return OtherKind
+}
+
+////////////////
+
+// Node is a resource in a Graph.
+type Node struct {
+	URI       string
+	Mimetype  string
+	Size      int64  // size in bytes, or -1 if unknown
+	Integrity string // Subresource Integrity metadata of scripts and stylesheets, see Graph.Integrity
+}
+
+// Edge is a reference from a document to a resource in a Graph. The embedded Resource holds the URI, the referrer and where it was found.
+type Edge struct {
+	Resource
+	Kind Kind
+}
+
+// Graph is a ResourceHandler that records the dependency graph of the resources found, with a node for each URI and an edge for each reference.
+type Graph struct {
+	// Integrity, if not empty, is the hash algorithm (sha256, sha384 or sha512) of the Subresource Integrity metadata that is computed for the scripts and stylesheets that are opened.
+	Integrity string
+
+	nodes map[string]*Node
+	order []string // URIs in order of discovery
+	edges []Edge
+	mutex sync.Mutex
+}
+
+func NewGraph() *Graph {
+	return &Graph{"", make(map[string]*Node), []string{}, []Edge{}, sync.Mutex{}}
+}
+
+// ParseGraph parses r with mimetype and served by uri. It returns the dependency graph of the local resources for all media. If FileOpener is not nil, it will read and parse the referenced URIs recursively and record the mimetype and size of the files it opens.
+func ParseGraph(baseURL string, opener FileOpener, r io.Reader, mimetype, uri string) (*Graph, error) {
+	g := NewGraph()
+	return g, g.Parse(baseURL, opener, r, mimetype, uri)
+}
+
+// Parse parses r like ParseGraph and adds the resources found to the graph, so that the graph of multiple documents can be combined.
+func (g *Graph) Parse(baseURL string, opener FileOpener, r io.Reader, mimetype, uri string) error {
+	g.setNode(uri, mimetype, readerSize(r))
+	if opener != nil {
+		inner := opener
+		opener = FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+			r, mimetype, err := inner.Open(uri)
+			if err != nil {
+				return r, mimetype, err
+			}
+			g.setNode(uri, mimetype, readerSize(r))
+
+			if kind := ResourceKind(Resource{URI: uri}); g.Integrity != "" && (kind == ScriptKind || kind == StyleKind || mimetype == "text/css") {
+				b, err := ioutil.ReadAll(r)
+				if closer, ok := r.(io.Closer); ok {
+					closer.Close()
+				}
+				if err != nil {
+					return nil, "", err
+				}
+				integrity, _ := Integrity(bytes.NewReader(b), g.Integrity)
+				g.mutex.Lock()
+				g.node(uri).Integrity = integrity
+				g.mutex.Unlock()
+				r = bytes.NewReader(b)
+			}
+			return r, mimetype, nil
+		})
+	}
+
+	parser, err := NewParser(baseURL, opener, g)
+	if err != nil {
+		return err
+	}
+	parser.MediaPolicy = nil
+	return parser.Parse(r, mimetype, uri)
+}
+
+func (g *Graph) URI(uri string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.node(uri)
+	return nil
+}
+
+func (g *Graph) Resource(res Resource) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if res.Referrer != "" {
+		g.node(res.Referrer)
+	}
+	g.node(res.URI)
+	g.edges = append(g.edges, Edge{res, ResourceKind(res)})
+	return nil
+}
+
+// node returns the node of uri and adds it if it does not exist, the mutex must be held.
+func (g *Graph) node(uri string) *Node {
+	node, ok := g.nodes[uri]
+	if !ok {
+		node = &Node{uri, extMimetype(path.Ext(uri)), -1, ""}
+		g.nodes[uri] = node
+		g.order = append(g.order, uri)
+	}
+	return node
+}
+
+func (g *Graph) setNode(uri, mimetype string, size int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	node := g.node(uri)
+	if mimetype != "" {
+		node.Mimetype = mimetype
+	}
+	if size != -1 {
+		node.Size = size
+	}
+}
+
+// Node returns the node of uri.
+func (g *Graph) Node(uri string) (Node, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if node, ok := g.nodes[uri]; ok {
+		return *node, true
+	}
+	return Node{}, false
+}
+
+// Nodes returns all nodes in order of discovery.
+func (g *Graph) Nodes() []Node {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	nodes := make([]Node, 0, len(g.order))
+	for _, uri := range g.order {
+		nodes = append(nodes, *g.nodes[uri])
+	}
+	return nodes
+}
+
+// Edges returns all edges in order of discovery.
+func (g *Graph) Edges() []Edge {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return append([]Edge{}, g.edges...)
+}
+
+// Deps returns the URIs that are referenced directly by uri.
+func (g *Graph) Deps(uri string) []string {
+	return g.walk(uri, false, false)
+}
+
+// TransitiveDeps returns the URIs that are referenced by uri directly or indirectly, in breadth-first order.
+func (g *Graph) TransitiveDeps(uri string) []string {
+	return g.walk(uri, false, true)
+}
+
+// Dependents returns the URIs that reference uri directly.
+func (g *Graph) Dependents(uri string) []string {
+	return g.walk(uri, true, false)
+}
+
+// TransitiveDependents returns the URIs that reference uri directly or indirectly, in breadth-first order.
+func (g *Graph) TransitiveDependents(uri string) []string {
+	return g.walk(uri, true, true)
+}
+
+func (g *Graph) walk(uri string, reverse, transitive bool) []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	adjacent := map[string][]string{}
+	for _, edge := range g.edges {
+		from, to := edge.Referrer, edge.URI
+		if reverse {
+			from, to = to, from
+		}
+		adjacent[from] = append(adjacent[from], to)
+	}
+
+	uris := []string{}
+	visited := map[string]bool{uri: true}
+	queue := []string{uri}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, to := range adjacent[cur] {
+			if !visited[to] {
+				visited[to] = true
+				uris = append(uris, to)
+				if transitive {
+					queue = append(queue, to)
+				}
+			}
+		}
+	}
+	return uris
+}
+
+// TopologicalOrder returns all URIs ordered so that each referrer comes before the resources it references, otherwise in order of discovery. If the graph has a cycle, the URIs in the cycle are appended in order of discovery and ErrCycle is returned.
+func (g *Graph) TopologicalOrder() ([]string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	index := make(map[string]int, len(g.order))
+	for i, uri := range g.order {
+		index[uri] = i
+	}
+	indegree := make([]int, len(g.order))
+	adjacent := make([][]int, len(g.order))
+	seen := map[[2]string]bool{}
+	for _, edge := range g.edges {
+		if pair := [2]string{edge.Referrer, edge.URI}; edge.Referrer != "" && !seen[pair] {
+			seen[pair] = true
+			from, to := index[edge.Referrer], index[edge.URI]
+			adjacent[from] = append(adjacent[from], to)
+			indegree[to]++
+		}
+	}
+
+	// Kahn's algorithm, the ready URI that was discovered first is taken next
+	ready := &intHeap{}
+	for i := range g.order {
+		if indegree[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+	uris := make([]string, 0, len(g.order))
+	done := make([]bool, len(g.order))
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		done[i] = true
+		uris = append(uris, g.order[i])
+		for _, j := range adjacent[i] {
+			if indegree[j]--; indegree[j] == 0 {
+				heap.Push(ready, j)
+			}
+		}
+	}
+	if len(uris) < len(g.order) {
+		for i, uri := range g.order {
+			if !done[i] {
+				uris = append(uris, uri)
+			}
+		}
+		return uris, ErrCycle
+	}
+	return uris, nil
+}
+
+// intHeap is a min-heap of ints for container/heap.
+type intHeap []int
+
+func (h intHeap) Len() int           { return len(h) }
+func (h intHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h intHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *intHeap) Push(x interface{}) {
+	*h = append(*h, x.(int))
+}
+
+func (h *intHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+////////////////
+
+// GraphVersion is the version of the JSON schema of a Graph.
+const GraphVersion = 1
+
+type graphJSON struct {
+	Version int             `json:"version"`
+	Nodes   []graphNodeJSON `json:"nodes"`
+	Edges   []graphEdgeJSON `json:"edges"`
+}
+
+type graphNodeJSON struct {
+	URI       string `json:"uri"`
+	Mimetype  string `json:"mimetype,omitempty"`
+	Size      *int64 `json:"size,omitempty"` // omitted if unknown
+	Integrity string `json:"integrity,omitempty"`
+}
+
+type graphEdgeJSON struct {
+	Referrer  string `json:"referrer"`
+	URI       string `json:"uri"`
+	Element   string `json:"element,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Kind      string `json:"kind"`
+	Context   string `json:"context,omitempty"` // omitted for live resources
+	Media     string `json:"media,omitempty"`
+}
+
+// MarshalJSON encodes the graph as an object with version, nodes and edges. Nodes and edges are in order of discovery.
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	v := graphJSON{GraphVersion, []graphNodeJSON{}, []graphEdgeJSON{}}
+	for _, node := range g.Nodes() {
+		n := graphNodeJSON{node.URI, node.Mimetype, nil, node.Integrity}
+		if node.Size != -1 {
+			size := node.Size
+			n.Size = &size
+		}
+		v.Nodes = append(v.Nodes, n)
+	}
+	for _, edge := range g.Edges() {
+		e := graphEdgeJSON{edge.Referrer, edge.URI, edge.Element, edge.Attribute, edge.Kind.String(), "", edge.Media}
+		if edge.Context != LiveContext {
+			e.Context = edge.Context.String()
+		}
+		v.Edges = append(v.Edges, e)
+	}
+	return json.Marshal(v)
+}
+
+// WriteJSON writes the graph as indented JSON, see MarshalJSON.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	b, err := g.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err = json.Indent(buf, b, "", "\t"); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language. Nodes are styled by mimetype and edges are labeled by the referencing attribute, or the element for element content.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph push {\n\trankdir=LR;\n\tnode [style=filled, fontname=Helvetica];\n\tedge [fontname=Helvetica, fontsize=10];\n")
+	for _, node := range g.Nodes() {
+		fmt.Fprintf(bw, "\t%s [%s];\n", dotQuote(node.URI), dotNodeStyle(node.Mimetype))
+	}
+	for _, edge := range g.Edges() {
+		label := edge.Attribute
+		if label == "" {
+			label = edge.Element
+		}
+		fmt.Fprintf(bw, "\t%s -> %s [label=%s", dotQuote(edge.Referrer), dotQuote(edge.URI), dotQuote(label))
+		if edge.Context != LiveContext {
+			bw.WriteString(", style=dashed")
+		}
+		bw.WriteString("];\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+func dotNodeStyle(mimetype string) string {
+	shape, color := "ellipse", "#f5f5f5"
+	switch {
+	case mimetype == "text/html":
+		shape, color = "box", "#dae8fc"
+	case mimetype == "text/css":
+		shape, color = "box", "#d5e8d4"
+	case strings.HasSuffix(mimetype, "javascript"):
+		shape, color = "box", "#fff2cc"
+	case mimetype != "application/dash+xml" && (strings.HasSuffix(mimetype, "+xml") || strings.HasSuffix(mimetype, "/xml")):
+		shape, color = "note", "#f8cecc"
+	case strings.HasPrefix(mimetype, "image/"):
+		color = "#f8cecc"
+	case strings.Contains(mimetype, "font"):
+		color = "#e1d5e7"
+	case strings.HasPrefix(mimetype, "video/") || strings.HasPrefix(mimetype, "audio/") || strings.HasSuffix(mimetype, "mpegurl") || mimetype == "application/dash+xml":
+		color = "#ffe6cc"
+	}
+	return fmt.Sprintf("shape=%s, fillcolor=%s", shape, dotQuote(color))
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+////////////////
+
+// extMimetype returns the mimetype of an extension without parameters.
+func extMimetype(ext string) string {
+	if mimetype, ok := ExtToMimetype[ext]; ok && ext != "" {
+		return mimetype
+	}
+	if mimetype, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return mimetype
+	}
+	return ""
+}
+
+// readerSize returns the size of the contents of r if it can be known without reading, or -1 otherwise.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case *os.File:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	case *bytes.Reader:
+		return int64(r.Len())
+	case *bytes.Buffer:
+		return int64(r.Len())
+	case *strings.Reader:
+		return int64(r.Len())
+	}
+	return -1
+}
@@ -0,0 +1,137 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestGraph(t *testing.T) {
+	files := map[string]string{
+		"/style.css": `@import "/base.css"; @font-face { src: url(/font.woff2); } a { background: url(/bg.png); }`,
+		"/base.css":  `b { background: url(/bg.png); }`,
+	}
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if content, ok := files[uri]; ok {
+			return strings.NewReader(content), "text/css", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	html := `<link rel="stylesheet" href="/style.css"><script src="/app.js"></script>`
+	g, err := ParseGraph("", opener, bytes.NewBufferString(html), "text/html", "/index.html")
+	test.Error(t, err, nil)
+
+	node, ok := g.Node("/index.html")
+	test.That(t, ok)
+	test.String(t, node.Mimetype, "text/html")
+	test.That(t, node.Size == int64(len(html)), "size of index.html")
+	node, ok = g.Node("/style.css")
+	test.That(t, ok)
+	test.That(t, node.Size == int64(len(files["/style.css"])), "size of style.css")
+	node, ok = g.Node("/bg.png")
+	test.That(t, ok)
+	test.String(t, node.Mimetype, "image/png")
+	test.That(t, node.Size == -1, "unknown size of bg.png")
+	test.That(t, len(g.Nodes()) == 6, "number of nodes")
+
+	kinds := map[string]Kind{}
+	for _, edge := range g.Edges() {
+		kinds[edge.URI] = edge.Kind
+	}
+	test.String(t, kinds["/style.css"].String(), "style")
+	test.String(t, kinds["/base.css"].String(), "style")
+	test.String(t, kinds["/app.js"].String(), "script")
+	test.String(t, kinds["/font.woff2"].String(), "font")
+	test.String(t, kinds["/bg.png"].String(), "image")
+
+	test.String(t, strings.Join(g.Deps("/index.html"), ","), "/style.css,/app.js")
+	test.String(t, strings.Join(g.Dependents("/bg.png"), ","), "/style.css,/base.css")
+	test.String(t, strings.Join(g.TransitiveDependents("/bg.png"), ","), "/style.css,/base.css,/index.html")
+
+	deps := g.TransitiveDeps("/index.html")
+	test.That(t, len(deps) == 5, "number of transitive deps")
+	test.String(t, strings.Join(deps[:2], ","), "/style.css,/app.js")
+
+	order, err := g.TopologicalOrder()
+	test.Error(t, err, nil)
+	index := map[string]int{}
+	for i, uri := range order {
+		index[uri] = i
+	}
+	test.That(t, len(order) == 6, "number of ordered nodes")
+	for _, edge := range g.Edges() {
+		test.That(t, index[edge.Referrer] < index[edge.URI], edge.Referrer+" before "+edge.URI)
+	}
+
+	g, err = ParseGraph("", nil, bytes.NewBufferString(`<link rel="stylesheet" href="/print.css" media="print">`), "text/html", "/print.html")
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(g.Deps("/print.html"), ","), "/print.css", "resources for all media")
+}
+
+func TestGraphIntegrity(t *testing.T) {
+	g := NewGraph()
+	g.Integrity = "sha256"
+	test.Error(t, g.Parse("", integrityOpener, bytes.NewBufferString(`<script src="/app.js"></script><img src="/missing.png">`), "text/html", "/index.html"), nil)
+
+	node, _ := g.Node("/app.js")
+	test.String(t, node.Integrity, "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI=")
+	node, _ = g.Node("/index.html")
+	test.String(t, node.Integrity, "")
+
+	b, err := json.Marshal(g)
+	test.Error(t, err, nil)
+	test.That(t, bytes.Contains(b, []byte(`"size":8,"integrity":"sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="}`)), string(b))
+}
+
+func TestGraphCycle(t *testing.T) {
+	g := NewGraph()
+	g.Resource(Resource{URI: "/a.css", Referrer: "/index.html"})
+	g.Resource(Resource{URI: "/b.css", Referrer: "/a.css"})
+	g.Resource(Resource{URI: "/a.css", Referrer: "/b.css"})
+
+	order, err := g.TopologicalOrder()
+	test.Error(t, err, ErrCycle)
+	test.String(t, strings.Join(order, ","), "/index.html,/a.css,/b.css")
+	test.String(t, strings.Join(g.TransitiveDeps("/a.css"), ","), "/b.css")
+}
+
+func TestGraphJSON(t *testing.T) {
+	g := NewGraph()
+	g.setNode("/index.html", "text/html", 42)
+	g.Resource(Resource{URI: "/style.css", Referrer: "/index.html", Element: "link", Attribute: "href"})
+	g.Resource(Resource{URI: "/old.png", Referrer: "/index.html", Element: "img", Attribute: "src", Context: NoscriptContext, Media: "print"})
+
+	b, err := json.Marshal(g)
+	test.Error(t, err, nil)
+	test.String(t, string(b), `{"version":1,"nodes":[{"uri":"/index.html","mimetype":"text/html","size":42},{"uri":"/style.css","mimetype":"text/css"},{"uri":"/old.png","mimetype":"image/png"}],"edges":[{"referrer":"/index.html","uri":"/style.css","element":"link","attribute":"href","kind":"style"},{"referrer":"/index.html","uri":"/old.png","element":"img","attribute":"src","kind":"image","context":"noscript","media":"print"}]}`)
+}
+
+func TestGraphDOT(t *testing.T) {
+	g := NewGraph()
+	g.setNode("/index.html", "text/html", 42)
+	g.Resource(Resource{URI: "/style.css", Referrer: "/index.html", Element: "link", Attribute: "href"})
+	g.Resource(Resource{URI: "/bg.png", Referrer: "/style.css", Attribute: "background"})
+	g.Resource(Resource{URI: `/a"b.js`, Referrer: "/index.html", Element: "script", Context: TemplateContext})
+
+	buf := &bytes.Buffer{}
+	test.Error(t, g.WriteDOT(buf), nil)
+	test.String(t, buf.String(), `digraph push {
+	rankdir=LR;
+	node [style=filled, fontname=Helvetica];
+	edge [fontname=Helvetica, fontsize=10];
+	"/index.html" [shape=box, fillcolor="#dae8fc"];
+	"/style.css" [shape=box, fillcolor="#d5e8d4"];
+	"/bg.png" [shape=ellipse, fillcolor="#f8cecc"];
+	"/a\"b.js" [shape=box, fillcolor="#fff2cc"];
+	"/index.html" -> "/style.css" [label="href"];
+	"/style.css" -> "/bg.png" [label="background"];
+	"/index.html" -> "/a\"b.js" [label="script", style=dashed];
+}
+`)
+}
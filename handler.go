@@ -20,6 +20,45 @@ func (f URIHandlerFunc) URI(uri string) error {
 	return f(uri)
 }
 
+// Resource describes a resource URI and where it was found.
+type Resource struct {
+	URI       string
+	Referrer  string // URI of the document referencing the resource
+	Element   string // element, tag or property in the referrer that references the resource
+	Attribute string // attribute of Element that holds the resource, empty for element content
+	Context   Context
+	Media     string // media query list of the nearest element or at-rule that restricts the resource to certain media, empty for all media
+	Offset    int64  // byte offset of the referencing HTML element in the parsed document, resources in embedded or referenced documents add to the offset of the embedding or referencing element
+	Head      bool   // referenced inside the head of an HTML document, also when <head> is omitted
+	Deferred  bool   // referenced by an element with an async or defer attribute, or with loading="lazy"
+
+	pos int64 // byte offset of the reference in the file of the referrer, or of the embedded document while it is parsed, -1 if unknown
+}
+
+// in returns the origin of a resource found in element and attribute. Documents embedded in another document, such as inline CSS or iframe srcdoc, keep the origin of their parent.
+func (r Resource) in(element, attribute string) Resource {
+	if r.Element == "" && r.Attribute == "" {
+		r.Element, r.Attribute = element, attribute
+	}
+	return r
+}
+
+// at returns the resource at n bytes from its position, the position is unknown if either is -1.
+func (r Resource) at(n int64) Resource {
+	if r.pos == -1 || n == -1 {
+		r.pos = -1
+	} else {
+		r.pos += n
+	}
+	return r
+}
+
+// ResourceHandler is a URIHandler that additionally receives where the resource URI was found. The Parser calls Resource instead of URI for URIHandlers that implement it.
+type ResourceHandler interface {
+	URIHandler
+	Resource(Resource) error
+}
+
 ////////////////
 
 // PushHandler is a URIHandler that pushes resources to the client.
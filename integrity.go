@@ -0,0 +1,164 @@
+package push
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/tdewolff/parse"
+	"github.com/tdewolff/parse/html"
+)
+
+// ErrIntegrityAlgorithm is returned for hash algorithms other than sha256, sha384 and sha512.
+var ErrIntegrityAlgorithm = errors.New("unknown integrity hash algorithm")
+
+// Integrity returns the Subresource Integrity metadata of the contents of r, such as sha384-..., for the algorithm sha256, sha384 or sha512.
+func Integrity(r io.Reader, algorithm string) (string, error) {
+	h, err := newIntegrityHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return integrityMetadata(h, algorithm), nil
+}
+
+func newIntegrityHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, ErrIntegrityAlgorithm
+}
+
+func integrityMetadata(h hash.Hash, algorithm string) string {
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// IntegrityWriter wraps an io.Writer that adds integrity attributes to the local <script src="..."> and <link rel="stylesheet" href="..."> elements of an HTML document served by uri. The hashes are computed with algorithm over the files opened by the FileOpener of parser. Elements that already have an integrity attribute, or of which the file cannot be opened, are written unchanged.
+// Write errors are returned by Close on the writer. The writer must be closed explicitly.
+func IntegrityWriter(w io.Writer, parser *Parser, uri, algorithm string) *pushingWriter {
+	return integrityWriter(w, parser, uri, algorithm, newResourceInfos(parser.opener))
+}
+
+// integrityWriter is IntegrityWriter with the hashes cached in infos.
+func integrityWriter(w io.Writer, parser *Parser, uri, algorithm string, infos *resourceInfos) *pushingWriter {
+	pr, pw := io.Pipe()
+	writer := &pushingWriter{pw, sync.WaitGroup{}, nil}
+	writer.wg.Add(1)
+	go func() {
+		defer writer.wg.Done()
+
+		if err := parser.rewriteIntegrity(w, pr, uri, algorithm, infos); err != nil {
+			io.Copy(ioutil.Discard, pr) // drain pr to unblock writes
+			writer.err = err
+		}
+		pr.Close()
+	}()
+	return writer
+}
+
+func (p *Parser) rewriteIntegrity(w io.Writer, r io.Reader, uri, algorithm string, infos *resourceInfos) error {
+	reqURL, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	var tag []byte // buffered script or link start tag
+	var tagHash html.Hash
+	var src string
+	var isStylesheet, hasIntegrity bool
+
+	lexer := html.NewLexer(r)
+	for {
+		tt, data := lexer.Next()
+		out := data
+		switch tt {
+		case html.ErrorToken:
+			if lexer.Err() != io.EOF {
+				return lexer.Err()
+			}
+			_, err := w.Write(tag)
+			return err
+		case html.StartTagToken:
+			if tagHash = html.ToHash(lexer.Text()); tagHash == html.Script || tagHash == html.Link {
+				tag = append(tag[:0], data...)
+				src, isStylesheet, hasIntegrity = "", false, false
+				out = nil
+			}
+		case html.AttributeToken:
+			if len(tag) > 0 {
+				tag = append(tag, data...)
+				out = nil
+
+				attr := html.ToHash(lexer.Text())
+				attrVal := lexer.AttrVal()
+				if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
+					attrVal = parse.TrimWhitespace(attrVal[1 : len(attrVal)-1])
+				}
+				if attr == html.Src && tagHash == html.Script || attr == html.Href && tagHash == html.Link {
+					src = string(attrVal)
+				} else if attr == html.Rel {
+					for _, rel := range strings.Fields(strings.ToLower(string(attrVal))) {
+						isStylesheet = isStylesheet || rel == "stylesheet"
+					}
+				} else if parse.Equal(lexer.Text(), []byte("integrity")) {
+					hasIntegrity = true
+				}
+			}
+		case html.StartTagCloseToken, html.StartTagVoidToken:
+			if len(tag) > 0 {
+				if src != "" && !hasIntegrity && (tagHash == html.Script || isStylesheet) {
+					if integrity := p.integrity(src, reqURL, algorithm, infos); integrity != "" {
+						tag = append(tag, ` integrity="`...)
+						tag = append(tag, integrity...)
+						tag = append(tag, '"')
+					}
+				}
+				out = append(tag, data...)
+				tag = tag[:0]
+			}
+		}
+		if len(out) > 0 {
+			if _, err := w.Write(out); err != nil {
+				return err
+			}
+		}
+		lexer.Free(len(data))
+	}
+}
+
+// integrity returns the integrity metadata of a local resource, or an empty string if it cannot be opened.
+func (p *Parser) integrity(rawURL string, reqURL *url.URL, algorithm string, infos *resourceInfos) string {
+	uri := p.linkURI(rawURL, reqURL)
+	if uri == "" {
+		return ""
+	}
+	return infos.integrity(uri, algorithm)
+}
+
+// integrityResponseWriter wraps w to add integrity attributes to HTML responses. Hashes are cached across responses until the files change.
+func (p *P) integrityResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	parser, err := NewParser(p.baseURL, p.opener, nil)
+	if err != nil {
+		return w
+	}
+	mimetype, _ := ExtToMimetype[path.Ext(r.URL.Path)]
+	return &htmlResponseWriter{w, mimetype, func(w io.Writer) io.WriteCloser {
+		return integrityWriter(w, parser, r.RequestURI, p.Integrity, p.infos)
+	}, nil, false}
+}
@@ -0,0 +1,145 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/test"
+)
+
+func TestIntegrity(t *testing.T) {
+	var integrityTests = []struct {
+		algorithm string
+		expected  string
+	}{
+		{"sha256", "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="},
+		{"sha384", "sha384-HT2E9NfWiuQ/w1PRai+hTyqW16NIoCGA/m8VQDUopfAtcz6YQjtsMmQd5uRbVDpW"},
+		{"sha512", "sha512-+uuYUxxe7oWIShQrWEmMn/fixz/rxDP4qcAZddXLDM3nN8/tpk1ZC2jXQk6N+mXE65jwfzNVUJL/qjA3y9KbuQ=="},
+	}
+	for _, tt := range integrityTests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			integrity, err := Integrity(strings.NewReader("alert(1)"), tt.algorithm)
+			test.Error(t, err, nil)
+			test.String(t, integrity, tt.expected)
+		})
+	}
+
+	_, err := Integrity(strings.NewReader("alert(1)"), "md5")
+	test.Error(t, err, ErrIntegrityAlgorithm)
+}
+
+var integrityOpener = FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+	switch uri {
+	case "/app.js":
+		return strings.NewReader("alert(1)"), "", nil
+	case "/style.css":
+		return strings.NewReader("a{}"), "text/css", nil
+	}
+	return nil, "", os.ErrNotExist
+})
+
+func TestIntegrityWriter(t *testing.T) {
+	var integrityTests = []struct {
+		html     string
+		expected string
+	}{
+		{`<script src="app.js"></script>`, `<script src="app.js" integrity="sha384-HT2E9NfWiuQ/w1PRai+hTyqW16NIoCGA/m8VQDUopfAtcz6YQjtsMmQd5uRbVDpW"></script>`},
+		{`<link rel="stylesheet" href="/style.css?v=1"/>`, `<link rel="stylesheet" href="/style.css?v=1" integrity="sha384-m4Zcd9m9Kerya2aMKZ9CuL1yv7QLjdpmEo79GaQCk1uO2U4trsxWuyqSJsOzpOru"/>`},
+		{`<link rel="icon" href="/style.css">`, `<link rel="icon" href="/style.css">`},
+		{`<script src="/app.js" integrity="sha256-x"></script>`, `<script src="/app.js" integrity="sha256-x"></script>`},
+		{`<script src="/missing.js"></script>`, `<script src="/missing.js"></script>`},
+		{`<script src="http://other.com/app.js"></script><p>text</p>`, `<script src="http://other.com/app.js"></script><p>text</p>`},
+		{`<script>var a = "<script src=/app.js>";</script>`, `<script>var a = "<script src=/app.js>";</script>`},
+	}
+
+	parser, err := NewParser("example.com/", integrityOpener, nil)
+	test.Error(t, err, nil)
+	for _, tt := range integrityTests {
+		t.Run(tt.html, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := IntegrityWriter(buf, parser, "/index.html", "sha384")
+			w.Write([]byte(tt.html))
+			test.Error(t, w.Close(), nil)
+			test.String(t, buf.String(), tt.expected)
+		})
+	}
+}
+
+func TestResponseWriterIntegrity(t *testing.T) {
+	p := New("", integrityOpener, nil)
+	p.Integrity = "sha256"
+
+	// not a Pusher
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Length", "30")
+	pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, ErrNoPusher)
+	pw.Write([]byte(`<script src="/app.js"></script>`))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, w.Body.String(), `<script src="/app.js" integrity="sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="></script>`)
+	test.String(t, w.Header().Get("Content-Length"), "")
+
+	// pushing
+	pusher := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err = p.ResponseWriter(pusher, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(`<script src="/app.js"></script>`))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, pusher.Body.String(), `<script src="/app.js" integrity="sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="></script>`)
+	test.String(t, strings.Join(pusher.URIs, ","), "/app.js")
+}
+
+func TestIntegrityCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.js")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(content string, modTime time.Time) {
+		test.Error(t, ioutil.WriteFile(filename, []byte(content), 0644), nil)
+		test.Error(t, os.Chtimes(filename, modTime, modTime), nil)
+	}
+
+	infos := newResourceInfos(NewDefaultFileOpener(dir))
+	write("alert('a');", modTime)
+	integrity := infos.integrity("/app.js?v=1", "sha256")
+	test.That(t, integrity != "")
+	test.String(t, infos.integrity("/app.js", "sha384"), integrityOf(t, "alert('a');", "sha384"))
+
+	write("alert('b');", modTime)
+	test.String(t, infos.integrity("/app.js", "sha256"), integrity, "same modification time and size")
+	write("alert('b');", modTime.Add(time.Second))
+	test.String(t, infos.integrity("/app.js", "sha256"), integrityOf(t, "alert('b');", "sha256"))
+
+	test.Error(t, os.Remove(filename), nil)
+	test.String(t, infos.integrity("/app.js", "sha256"), "")
+
+	// not a file
+	opens := 0
+	infos = newResourceInfos(FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		opens++
+		return integrityOpener(uri)
+	}))
+	now := time.Now()
+	infos.now = func() time.Time { return now }
+	test.String(t, infos.integrity("/app.js", "sha256"), "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI=")
+	test.String(t, infos.integrity("/app.js", "sha256"), "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI=")
+	test.That(t, opens == 1, "cached for ResourceInfoTTL")
+	now = now.Add(ResourceInfoTTL)
+	infos.integrity("/app.js", "sha256")
+	test.That(t, opens == 2, "read again after ResourceInfoTTL")
+}
+
+func integrityOf(t *testing.T, content, algorithm string) string {
+	integrity, err := Integrity(strings.NewReader(content), algorithm)
+	test.Error(t, err, nil)
+	return integrity
+}
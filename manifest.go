@@ -0,0 +1,143 @@
+package push
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PushManifest maps page URIs to the resources to push, in the push_manifest.json format used by Firebase Hosting and the Polymer tooling.
+type PushManifest map[string]map[string]PushManifestEntry
+
+// PushManifestEntry is a resource in a PushManifest.
+type PushManifestEntry struct {
+	Type   string `json:"type"`   // request destination, such as document, style, script, image or font
+	Weight int    `json:"weight"` // HTTP/2 stream weight between 1 and 256, see Priority.Weight
+}
+
+// NewPushManifest parses the pages with uris and the local resources they reference recursively, and returns a PushManifest with all resources of each page for all media. The weight of a resource is that of its ResourcePriority, the highest if it is referenced more than once. Pages without parser are skipped.
+func NewPushManifest(baseURL string, opener FileOpener, uris []string) (PushManifest, error) {
+	m := PushManifest{}
+	for _, uri := range uris {
+		r, mimetype, err := opener.Open(uri)
+		if err != nil {
+			return m, err
+		}
+
+		h := &manifestHandler{map[string]PushManifestEntry{}, sync.Mutex{}}
+		parser, err := NewParser(baseURL, opener, h)
+		if err != nil {
+			return m, err
+		}
+		parser.MediaPolicy = nil
+		if err = parser.Parse(r, mimetype, uri); err == ErrNoParser {
+			continue
+		} else if err != nil {
+			return m, err
+		}
+		m[uri] = h.resources
+	}
+	return m, nil
+}
+
+// ReadPushManifest decodes a PushManifest from JSON.
+func ReadPushManifest(r io.Reader) (PushManifest, error) {
+	m := PushManifest{}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write encodes the manifest as indented JSON.
+func (m PushManifest) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Resources returns the resources of the page served at uri, ordered by decreasing weight and then by URI. Pages are matched by path with or without leading slash, and directories also by their index.html.
+func (m PushManifest) Resources(uri string) []string {
+	resources, ok := m[uri]
+	if !ok {
+		page := pageFile(uri)
+		for _, key := range []string{page, strings.TrimPrefix(uri, "/"), strings.TrimPrefix(page, "/")} {
+			if resources, ok = m[key]; ok {
+				break
+			}
+		}
+	}
+
+	uris := make([]string, 0, len(resources))
+	for uri := range resources {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool {
+		if resources[uris[i]].Weight != resources[uris[j]].Weight {
+			return resources[uris[i]].Weight > resources[uris[j]].Weight
+		}
+		return uris[i] < uris[j]
+	})
+	return uris
+}
+
+// PreloadLink returns the value of a Link header that preloads uri with the request destination as, such as a PushManifestEntry type. Fonts are preloaded with CORS as browsers require.
+func PreloadLink(uri, as string) string {
+	link := "<" + (&url.URL{Path: uri}).String() + ">; rel=preload; as=" + as
+	if as == "font" {
+		link += "; crossorigin"
+	}
+	return link
+}
+
+type manifestHandler struct {
+	resources map[string]PushManifestEntry
+	mutex     sync.Mutex
+}
+
+func (h *manifestHandler) URI(uri string) error {
+	return h.Resource(Resource{URI: uri})
+}
+
+func (h *manifestHandler) Resource(res Resource) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	weight := ResourcePriority(res).Weight()
+	if entry, ok := h.resources[res.URI]; !ok || entry.Weight < weight {
+		h.resources[res.URI] = PushManifestEntry{manifestType(res), weight}
+	}
+	return nil
+}
+
+// manifestType returns the request destination of a resource.
+func manifestType(res Resource) string {
+	switch ResourceKind(res) {
+	case DocumentKind:
+		return "document"
+	case StyleKind:
+		return "style"
+	case ScriptKind:
+		return "script"
+	case ImageKind:
+		return "image"
+	case FontKind:
+		return "font"
+	case MediaKind:
+		if res.Element == "audio" || strings.HasPrefix(mime.TypeByExtension(path.Ext(res.URI)), "audio/") {
+			return "audio"
+		} else if res.Element == "track" || path.Ext(res.URI) == ".vtt" {
+			return "track"
+		}
+		return "video"
+	}
+	return "fetch"
+}
@@ -0,0 +1,84 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestPushManifest(t *testing.T) {
+	files := map[string]string{
+		"/index.html": `<link rel="stylesheet" href="/style.css"><script src="/app.js"></script><video src="/movie.mp4"></video>`,
+		"/about.html": `<img src="/team.png">`,
+		"/style.css":  `@font-face { src: url(/font.woff2); }`,
+	}
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if content, ok := files[uri]; ok {
+			return strings.NewReader(content), ExtToMimetype[uri[strings.LastIndexByte(uri, '.'):]], nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	m, err := NewPushManifest("", opener, []string{"/index.html", "/about.html"})
+	test.Error(t, err, nil)
+
+	buf := &bytes.Buffer{}
+	test.Error(t, m.Write(buf), nil)
+	test.String(t, buf.String(), `{
+	"/about.html": {
+		"/team.png": {
+			"type": "image",
+			"weight": 183
+		}
+	},
+	"/index.html": {
+		"/app.js": {
+			"type": "script",
+			"weight": 256
+		},
+		"/font.woff2": {
+			"type": "font",
+			"weight": 220
+		},
+		"/movie.mp4": {
+			"type": "video",
+			"weight": 147
+		},
+		"/style.css": {
+			"type": "style",
+			"weight": 256
+		}
+	}
+}
+`)
+	test.String(t, strings.Join(m.Resources("/index.html"), ","), "/app.js,/style.css,/font.woff2,/movie.mp4", "ordered by priority")
+
+	m, err = ReadPushManifest(strings.NewReader(`{"index.html": {"/a.css": {"type": "style", "weight": 1}, "/b.js": {"type": "script", "weight": 2}}}`))
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(m.Resources("/"), ","), "/b.js,/a.css")
+	test.String(t, strings.Join(m.Resources("/index.html"), ","), "/b.js,/a.css")
+	test.String(t, strings.Join(m.Resources("/other.html"), ","), "")
+}
+
+func TestResponseWriterManifest(t *testing.T) {
+	p := New("", nil, NewDefaultCache())
+	p.Manifest = PushManifest{"/": {"/style.css": {"style", 1}}}
+
+	w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(`<img src="/image.png">`))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/style.css")
+}
+
+func TestPreloadLink(t *testing.T) {
+	test.String(t, PreloadLink("/style.css", "style"), "</style.css>; rel=preload; as=style")
+	test.String(t, PreloadLink("/font.woff2", "font"), "</font.woff2>; rel=preload; as=font; crossorigin")
+	test.String(t, PreloadLink(`/a "b".png`, "image"), "</a%20%22b%22.png>; rel=preload; as=image")
+}
@@ -0,0 +1,326 @@
+package push
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tdewolff/parse"
+	"github.com/tdewolff/parse/xml"
+)
+
+// DefaultMediaSegments is the default number of media segments that are extracted from HLS and DASH manifests.
+var DefaultMediaSegments = 3
+
+// parseHLS parses HLS playlists. It extracts variant and rendition playlists, init segments and the first media segments.
+func (p *Parser) parseHLS(r io.Reader, reqURL *url.URL) error {
+	isVariant := false
+	segments := 0
+
+	var offset, next int64 // offsets of the current and the next line
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			offset, next = next, next+int64(advance)
+		}
+		return advance, token, err
+	})
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		for len(line) > 0 && parse.IsWhitespace(line[0]) {
+			line = line[1:]
+			offset++
+		}
+		line = parse.TrimWhitespace(line)
+		if len(line) == 0 {
+			continue
+		} else if line[0] == '#' {
+			if bytes.HasPrefix(line, []byte("#EXT-X-STREAM-INF:")) {
+				isVariant = true
+			} else if bytes.HasPrefix(line, []byte("#EXT-X-MAP:")) || bytes.HasPrefix(line, []byte("#EXT-X-MEDIA:")) {
+				if uri, uriOffset := hlsAttribute(line, []byte("URI")); uri != nil {
+					ref := Resource{Element: string(line[1:bytes.IndexByte(line, ':')]), Attribute: "URI", pos: offset + int64(uriOffset)}
+					if err := p.parseURL(string(uri), reqURL, ref); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		ref := Resource{Element: "EXTINF", pos: offset}
+		if isVariant {
+			isVariant = false
+			ref.Element = "EXT-X-STREAM-INF"
+		} else if segments < p.MediaSegments {
+			segments++
+		} else {
+			continue
+		}
+		if err := p.parseURL(string(line), reqURL, ref); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// hlsAttribute returns the value of the attribute with name in an HLS tag line and its offset in the line, or nil if not present.
+func hlsAttribute(line, name []byte) ([]byte, int) {
+	i := bytes.IndexByte(line, ':')
+	if i == -1 {
+		return nil, 0
+	}
+	attrs := line[i+1:]
+	for len(attrs) > 0 {
+		eq := bytes.IndexByte(attrs, '=')
+		if eq == -1 {
+			return nil, 0
+		}
+		key := parse.TrimWhitespace(attrs[:eq])
+		attrs = attrs[eq+1:]
+
+		var val []byte
+		offset := len(line) - len(attrs)
+		if len(attrs) > 0 && attrs[0] == '"' {
+			end := bytes.IndexByte(attrs[1:], '"')
+			if end == -1 {
+				return nil, 0
+			}
+			offset++
+			val = attrs[1 : end+1]
+			attrs = attrs[end+2:]
+		} else {
+			end := bytes.IndexByte(attrs, ',')
+			if end == -1 {
+				end = len(attrs)
+			}
+			val = attrs[:end]
+			attrs = attrs[end:]
+		}
+		if bytes.Equal(key, name) {
+			return val, offset
+		}
+		if len(attrs) > 0 && attrs[0] == ',' {
+			attrs = attrs[1:]
+		}
+	}
+	return nil, 0
+}
+
+////////////////
+
+type dashTemplate struct {
+	initialization string
+	media          string
+	startNumber    int
+	times          []int
+	next           int
+}
+
+type dashElement struct {
+	tag       []byte
+	baseURL   *url.URL
+	template  *dashTemplate
+	id        string
+	bandwidth string
+	segments  int
+}
+
+// parseDASH parses DASH manifests. It extracts the init segments and the first media segments of each representation.
+func (p *Parser) parseDASH(r io.Reader, reqURL *url.URL) error {
+	stack := []*dashElement{{baseURL: reqURL}}
+
+	lexer := xml.NewLexer(r)
+	for {
+		tt, data := lexer.Next()
+		switch tt {
+		case xml.ErrorToken:
+			if lexer.Err() == io.EOF {
+				return nil
+			}
+			return lexer.Err()
+		case xml.StartTagToken:
+			parent := stack[len(stack)-1]
+			elem := &dashElement{}
+			*elem = *parent
+			elem.tag = append([]byte{}, lexer.Text()...)
+			elem.segments = 0
+
+			attrs := map[string]string{}
+			isVoid := false
+			for {
+				attrTokenType, _ := lexer.Next()
+				if attrTokenType != xml.AttributeToken {
+					isVoid = attrTokenType == xml.StartTagCloseVoidToken
+					break
+				}
+
+				attrVal := lexer.AttrVal()
+				if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
+					attrVal = parse.TrimWhitespace(attrVal[1 : len(attrVal)-1])
+				}
+				attrs[string(lexer.Text())] = string(attrVal)
+			}
+
+			if err := p.parseDASHElement(reqURL, parent, elem, attrs); err != nil {
+				return err
+			}
+			if isVoid {
+				if err := p.closeDASHElement(reqURL, elem); err != nil {
+					return err
+				}
+			} else {
+				stack = append(stack, elem)
+			}
+		case xml.EndTagToken:
+			if len(stack) > 1 {
+				elem := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if err := p.closeDASHElement(reqURL, elem); err != nil {
+					return err
+				}
+			}
+		case xml.TextToken:
+			if elem := stack[len(stack)-1]; len(stack) > 1 && parse.Equal(elem.tag, []byte("BaseURL")) {
+				if uri := parse.TrimWhitespace(data); len(uri) > 0 {
+					baseURL, err := url.Parse(string(uri))
+					if err != nil {
+						return err
+					}
+					stack[len(stack)-2].baseURL = elem.baseURL.ResolveReference(baseURL)
+				}
+			}
+		}
+		lexer.Free(len(data))
+	}
+}
+
+func (p *Parser) parseDASHElement(reqURL *url.URL, parent, elem *dashElement, attrs map[string]string) error {
+	switch string(elem.tag) {
+	case "Representation":
+		elem.id = attrs["id"]
+		elem.bandwidth = attrs["bandwidth"]
+	case "SegmentTemplate":
+		elem.template = &dashTemplate{startNumber: 1}
+		if parent.template != nil {
+			*elem.template = *parent.template
+			elem.template.times = nil
+		}
+		parent.template = elem.template
+		if initialization, ok := attrs["initialization"]; ok {
+			elem.template.initialization = initialization
+		}
+		if media, ok := attrs["media"]; ok {
+			elem.template.media = media
+		}
+		if startNumber, err := strconv.Atoi(attrs["startNumber"]); err == nil {
+			elem.template.startNumber = startNumber
+		}
+	case "S":
+		if elem.template == nil {
+			return nil
+		}
+		if t, err := strconv.Atoi(attrs["t"]); err == nil {
+			elem.template.next = t
+		}
+		d, _ := strconv.Atoi(attrs["d"])
+		n, _ := strconv.Atoi(attrs["r"])
+		for i := 0; (i <= n || n < 0) && len(elem.template.times) < p.MediaSegments; i++ {
+			elem.template.times = append(elem.template.times, elem.template.next)
+			elem.template.next += d
+		}
+	case "Initialization":
+		if sourceURL, ok := attrs["sourceURL"]; ok {
+			return p.parseDASHURL(sourceURL, reqURL, elem.baseURL, Resource{Element: "Initialization", Attribute: "sourceURL"})
+		}
+	case "SegmentURL":
+		if media, ok := attrs["media"]; ok && parent.segments < p.MediaSegments {
+			parent.segments++
+			return p.parseDASHURL(media, reqURL, elem.baseURL, Resource{Element: "SegmentURL", Attribute: "media"})
+		}
+	}
+	return nil
+}
+
+func (p *Parser) closeDASHElement(reqURL *url.URL, elem *dashElement) error {
+	if !parse.Equal(elem.tag, []byte("Representation")) || elem.template == nil {
+		return nil
+	}
+
+	template := elem.template
+	if template.initialization != "" {
+		ref := Resource{Element: "SegmentTemplate", Attribute: "initialization"}
+		if err := p.parseDASHURL(dashSubstitute(template.initialization, elem, 0, 0), reqURL, elem.baseURL, ref); err != nil {
+			return err
+		}
+	}
+	if template.media != "" {
+		for i := 0; i < p.MediaSegments; i++ {
+			time := 0
+			if template.times != nil {
+				if i >= len(template.times) {
+					break
+				}
+				time = template.times[i]
+			}
+			ref := Resource{Element: "SegmentTemplate", Attribute: "media"}
+			if err := p.parseDASHURL(dashSubstitute(template.media, elem, template.startNumber+i, time), reqURL, elem.baseURL, ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Parser) parseDASHURL(rawURL string, reqURL, baseURL *url.URL, ref Resource) error {
+	resURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	ref.pos = -1 // URLs are expanded from templates and resolved against BaseURL
+
+	return p.parseURL(baseURL.ResolveReference(resURL).String(), reqURL, ref)
+}
+
+// dashSubstitute replaces the $RepresentationID$, $Bandwidth$, $Number$ and $Time$ identifiers in a segment template.
+func dashSubstitute(template string, elem *dashElement, number, time int) string {
+	b := []byte{}
+	for {
+		start := strings.IndexByte(template, '$')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(template[start+1:], '$')
+		if end == -1 {
+			break
+		}
+		end += start + 1
+
+		b = append(b, template[:start]...)
+		ident, format := template[start+1:end], "%d"
+		if i := strings.IndexByte(ident, '%'); i != -1 {
+			ident, format = ident[:i], ident[i:]
+		}
+		switch ident {
+		case "":
+			b = append(b, '$')
+		case "RepresentationID":
+			b = append(b, elem.id...)
+		case "Bandwidth":
+			b = append(b, elem.bandwidth...)
+		case "Number":
+			b = append(b, fmt.Sprintf(format, number)...)
+		case "Time":
+			b = append(b, fmt.Sprintf(format, time)...)
+		default:
+			b = append(b, template[start:end+1]...)
+		}
+		template = template[end+1:]
+	}
+	return string(append(b, template...))
+}
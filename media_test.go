@@ -0,0 +1,107 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestHLSParser(t *testing.T) {
+	r := bytes.NewBufferString(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=640x360,AUDIO="aac"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720,AUDIO="aac"
+http://example.com/video/high/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000
+http://cdn.example.org/video/index.m3u8
+`)
+
+	uris, err := List("example.com/", nil, r, "application/vnd.apple.mpegurl", "/video/index.m3u8")
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(uris, ","), "/video/audio/en.m3u8,/video/low/index.m3u8,/video/high/index.m3u8")
+
+	r = bytes.NewBufferString(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+seg1.m4s
+#EXTINF:4.0,
+seg2.m4s
+#EXTINF:4.0,
+seg3.m4s
+#EXTINF:4.0,
+seg4.m4s
+#EXT-X-ENDLIST
+`)
+
+	uris, err = List("example.com/", nil, r, "application/vnd.apple.mpegurl", "/video/low/index.m3u8")
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(uris, ","), "/video/low/init.mp4,/video/low/seg1.m4s,/video/low/seg2.m4s,/video/low/seg3.m4s")
+}
+
+func TestDASHParser(t *testing.T) {
+	r := bytes.NewBufferString(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011">
+	<BaseURL>media/</BaseURL>
+	<Period>
+		<AdaptationSet mimeType="video/mp4">
+			<SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number%03d$.m4s" startNumber="1"/>
+			<Representation id="720p" bandwidth="2400000"/>
+		</AdaptationSet>
+		<AdaptationSet mimeType="audio/mp4">
+			<Representation id="audio" bandwidth="128000">
+				<SegmentTemplate initialization="a-init.mp4" media="a-$Time$.m4s">
+					<SegmentTimeline>
+						<S t="0" d="1000" r="1"/>
+						<S d="500"/>
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>
+		</AdaptationSet>
+		<AdaptationSet mimeType="text/vtt">
+			<Representation id="subs" bandwidth="256">
+				<BaseURL>subs/</BaseURL>
+				<SegmentList>
+					<Initialization sourceURL="init.vtt"/>
+					<SegmentURL media="1.vtt"/>
+					<SegmentURL media="2.vtt"/>
+				</SegmentList>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`)
+
+	h := NewListHandler()
+	parser, err := NewParser("example.com/", nil, h)
+	test.Error(t, err, nil)
+	parser.MediaSegments = 2
+
+	err = parser.Parse(r, "application/dash+xml", "/video/manifest.mpd")
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(h.URIs, ","), "/video/media/720p/init.mp4,/video/media/720p/001.m4s,/video/media/720p/002.m4s,/video/media/a-init.mp4,/video/media/a-0.m4s,/video/media/a-1000.m4s,/video/media/subs/init.vtt,/video/media/subs/1.vtt,/video/media/subs/2.vtt")
+}
+
+func TestRecursiveHLSParser(t *testing.T) {
+	r := bytes.NewBufferString(`<video src="/video/index.m3u8"></video>`)
+
+	resources := map[string]string{
+		"/video/index.m3u8":     "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nlow/index.m3u8\n",
+		"/video/low/index.m3u8": "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.0,\nseg1.m4s\n",
+	}
+	fileOpener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		return bytes.NewBufferString(resources[uri]), ExtToMimetype[path.Ext(uri)], nil
+	})
+
+	uris, err := List("example.com/", fileOpener, r, "text/html", "/index.html")
+	test.Error(t, err, nil)
+
+	sort.Strings(uris)
+	test.String(t, strings.Join(uris, ","), "/video/index.m3u8,/video/low/index.m3u8,/video/low/init.mp4,/video/low/seg1.m4s")
+}
@@ -3,7 +3,9 @@ package push
 import (
 	"bytes"
 	"errors"
+	entity "html"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"strings"
 	"sync"
@@ -19,6 +21,20 @@ import (
 // ErrNoParser is returned when the mimetype has no parser specified.
 var ErrNoParser = errors.New("mimetype has no parser")
 
+// ErrOutsideBaseURL is reported for references to resources outside of the base URL.
+var ErrOutsideBaseURL = errors.New("outside base URL")
+
+// ReferenceError is an error for a resource referenced by a document, it is passed to the ErrorHandler of a Parser.
+type ReferenceError struct {
+	Resource
+	Raw string // reference as written in the referrer
+	Err error
+}
+
+func (e *ReferenceError) Error() string {
+	return e.Referrer + ": " + e.Raw + ": " + e.Err.Error()
+}
+
 ////////////////
 
 // Parser parses resources and calls uriHandler for all found URIs.
@@ -26,9 +42,24 @@ type Parser struct {
 	baseURL    *url.URL
 	uriHandler URIHandler
 
+	// MediaSegments is the number of media segments that are extracted from HLS and DASH manifests.
+	MediaSegments int
+
+	// TemplatePolicy and NoscriptPolicy specify how to handle resources inside <template> and <noscript> elements. Both default to SkipContext.
+	TemplatePolicy ContextPolicy
+	NoscriptPolicy ContextPolicy
+
+	// MediaPolicy reports whether resources that apply only to a media query list are handled. If nil, resources are handled for all media. Defaults to DefaultMediaPolicy.
+	MediaPolicy MediaPolicy
+
+	// ErrorHandler is called for references outside the base URL, and for referenced resources that cannot be opened or parsed when recursive. These errors are ignored if nil.
+	ErrorHandler func(*ReferenceError)
+
 	// recursive
-	opener FileOpener
-	wg     sync.WaitGroup
+	opener       FileOpener
+	wg           sync.WaitGroup
+	visited      map[string]bool // URIs that are or have been parsed recursively
+	visitedMutex sync.Mutex
 }
 
 // NewParser returns a new Parser. rawBaseURL defines the prefix an URL must have to be considered a local resource. If FileOpener is not nil, it will read and parse the referenced URIs recursively.
@@ -40,7 +71,7 @@ func NewParser(rawBaseURL string, opener FileOpener, uriHandler URIHandler) (*Pa
 	if err != nil {
 		return nil, err
 	}
-	return &Parser{baseURL, uriHandler, opener, sync.WaitGroup{}}, nil
+	return &Parser{baseURL, uriHandler, DefaultMediaSegments, SkipContext, SkipContext, DefaultMediaPolicy, nil, opener, sync.WaitGroup{}, map[string]bool{}, sync.Mutex{}}, nil
 }
 
 // IsRecursive returns true when the URIs within documents are aso read and parsed.
@@ -52,34 +83,79 @@ func (p *Parser) IsRecursive() bool {
 func (p *Parser) Parse(r io.Reader, mimetype, uri string) error {
 	if p.IsRecursive() {
 		defer p.wg.Wait()
+		p.visitedMutex.Lock()
+		p.visited = map[string]bool{}
+		p.visitedMutex.Unlock()
+		if reqURL, err := url.Parse(uri); err == nil {
+			p.visit(reqURL.Path)
+		}
 	}
-	return p.parse(r, mimetype, uri)
+	return p.parse(r, mimetype, uri, Resource{})
 }
 
-func (p *Parser) parse(r io.Reader, mimetype, uri string) error {
+// visit returns true if uri has not been visited before, so that cyclic references are parsed only once.
+func (p *Parser) visit(uri string) bool {
+	p.visitedMutex.Lock()
+	defer p.visitedMutex.Unlock()
+	if p.visited[uri] {
+		return false
+	}
+	p.visited[uri] = true
+	return true
+}
+
+// parse parses r, ref holds the context and media of the referencing element for recursively parsed resources.
+func (p *Parser) parse(r io.Reader, mimetype, uri string, ref Resource) error {
 	reqURL, err := url.Parse(uri)
 	if err != nil {
 		return err
 	}
 
 	if mimetype == "text/html" {
-		return p.parseHTML(r, reqURL)
+		return p.parseHTML(r, reqURL, ref)
 	} else if mimetype == "text/css" {
-		return p.parseCSS(r, reqURL, false)
+		return p.parseCSS(r, reqURL, false, ref)
 	} else if mimetype == "image/svg+xml" {
-		return p.parseSVG(r, reqURL)
+		return p.parseSVG(r, reqURL, ref)
+	} else if mimetype == "application/atom+xml" || mimetype == "application/rss+xml" || mimetype == "application/xml" || mimetype == "text/xml" {
+		return p.parseXML(r, reqURL)
+	} else if mimetype == "application/vnd.apple.mpegurl" || mimetype == "application/x-mpegurl" {
+		return p.parseHLS(r, reqURL)
+	} else if mimetype == "application/dash+xml" {
+		return p.parseDASH(r, reqURL)
 	}
 	return ErrNoParser
 }
 
 ////////////////
 
-func (p *Parser) parseHTML(r io.Reader, reqURL *url.URL) error {
+type htmlAttr struct {
+	hash   html.Hash
+	name   string
+	val    []byte
+	offset int64 // offset of val in the document, -1 if unknown
+}
+
+func (p *Parser) parseHTML(r io.Reader, reqURL *url.URL, ref Resource) error {
 	var tag html.Hash
+	var tagName string
+	var tagRef Resource // ref of the current element
+	var tagSkip bool    // current element does not match the media policy
+	templateDepth, noscriptDepth := 0, 0
+	cur := ref // ref in the context of the current element
+
+	// <head> may be omitted, in which case the head ends at the first element that is not head content
+	// the contents of <noscript> and embedded documents, such as <iframe srcdoc="...">, are not in the head of the page
+	implicitHead := ref.Element == "" && ref.Context != NoscriptContext
+	attrs := []htmlAttr{}
+	n := int64(0) // offset of the current token in the document
 
 	lexer := html.NewLexer(r)
 	for {
 		tt, data := lexer.Next()
+		cur.Offset = ref.Offset + n
+		tokenOffset := n
+		n += int64(len(data))
 		switch tt {
 		case html.ErrorToken:
 			if lexer.Err() == io.EOF {
@@ -88,48 +164,121 @@ func (p *Parser) parseHTML(r io.Reader, reqURL *url.URL) error {
 			return lexer.Err()
 		case html.StartTagToken:
 			tag = html.ToHash(lexer.Text())
+			tagName = string(lexer.Text())
+			if tag == html.Template {
+				templateDepth++
+			} else if tag == html.Noscript {
+				noscriptDepth++
+			}
+			cur.Context = htmlContext(ref.Context, templateDepth, noscriptDepth)
+			if tag == html.Head {
+				cur.Head, implicitHead = true, false
+			} else if tag == html.Body {
+				cur.Head, implicitHead = false, false
+			} else if implicitHead {
+				cur.Head = isHeadContent(tag)
+				implicitHead = cur.Head
+			}
+
+			var media []byte
+			deferred := false
+			attrs = attrs[:0]
 			for {
-				attrTokenType, _ := lexer.Next()
+				attrTokenType, attrData := lexer.Next()
+				n += int64(len(attrData))
 				if attrTokenType != html.AttributeToken {
 					break
 				}
 
-				if attr := html.ToHash(lexer.Text()); attr == html.Style || attr == html.Src || attr == html.Srcset || attr == html.Poster || attr == html.Data || attr == html.Href && tag == html.Link {
+				attr := html.ToHash(lexer.Text())
+				if attr == html.Media || attr == html.Style || attr == html.Src || attr == html.Srcset || attr == html.Poster || attr == html.Data || attr == html.Href && tag == html.Link {
+					// the attribute value ends the attribute token
+					attrVal, valOffset := attrValue(lexer.AttrVal())
+					valOffset += n - int64(len(lexer.AttrVal()))
+					if attr == html.Media {
+						media = append([]byte{}, attrVal...)
+					} else {
+						attrs = append(attrs, htmlAttr{attr, string(lexer.Text()), append([]byte{}, attrVal...), valOffset})
+					}
+				} else if attr == html.Async || attr == html.Defer {
+					deferred = true
+				} else if parse.Equal(lexer.Text(), []byte("loading")) {
 					attrVal := lexer.AttrVal()
 					if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
 						attrVal = parse.TrimWhitespace(attrVal[1 : len(attrVal)-1])
 					}
+					deferred = deferred || strings.EqualFold(string(attrVal), "lazy")
+				} else if tag == html.Iframe && parse.Equal(lexer.Text(), []byte("srcdoc")) {
+					attrVal := lexer.AttrVal()
+					if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
+						attrVal = attrVal[1 : len(attrVal)-1]
+					}
+					attrs = append(attrs, htmlAttr{0, string(lexer.Text()), append([]byte{}, attrVal...), -1})
+				}
+			}
 
-					if attr == html.Style {
-						if err := p.parseCSS(buffer.NewReader(attrVal), reqURL, true); err != nil {
+			tagRef, tagSkip = cur, false
+			tagRef.Deferred = deferred
+			if len(media) > 0 {
+				tagRef.Media = string(media)
+				tagSkip = p.MediaPolicy != nil && !p.MediaPolicy(tagRef.Media)
+			}
+			if tagSkip {
+				break
+			}
+
+			for _, attr := range attrs {
+				attrRef := tagRef.in(tagName, attr.name).at(attr.offset)
+				if attr.hash == html.Style {
+					if err := p.parseCSS(buffer.NewReader(attr.val), reqURL, true, attrRef); err != nil {
+						return err
+					}
+				} else if attr.hash == html.Srcset {
+					uris, offsets := parseSrcset(attr.val)
+					for i, uri := range uris {
+						if err := p.parseURL(uri, reqURL, attrRef.at(int64(offsets[i]))); err != nil {
 							return err
 						}
-					} else {
-						if attr == html.Srcset {
-							for _, uri := range parseSrcset(attrVal) {
-								if err := p.parseURL(uri, reqURL); err != nil {
-									return err
-								}
-							}
-						} else {
-							if err := p.parseURL(string(attrVal), reqURL); err != nil {
-								return err
-							}
-						}
+					}
+				} else if attr.name == "srcdoc" {
+					srcdoc := entity.UnescapeString(string(attr.val)) // positions in the unescaped document are unknown
+					if err := p.parseHTML(strings.NewReader(srcdoc), reqURL, attrRef); err != nil {
+						return err
+					}
+				} else {
+					if err := p.parseURL(string(attr.val), reqURL, attrRef); err != nil {
+						return err
 					}
 				}
 			}
+		case html.EndTagToken:
+			if hash := html.ToHash(lexer.Text()); hash == html.Template && templateDepth > 0 {
+				templateDepth--
+			} else if hash == html.Noscript && noscriptDepth > 0 {
+				noscriptDepth--
+			} else if hash == html.Head {
+				cur.Head, implicitHead = false, false
+			}
+			cur.Context = htmlContext(ref.Context, templateDepth, noscriptDepth)
 		case html.SvgToken:
-			if err := p.parseSVG(buffer.NewReader(data), reqURL); err != nil {
+			if err := p.parseSVG(buffer.NewReader(data), reqURL, cur.in("svg", "").at(tokenOffset)); err != nil {
 				return err
 			}
 		case html.TextToken:
+			if tagSkip {
+				break
+			}
 			if tag == html.Style {
-				if err := p.parseCSS(buffer.NewReader(data), reqURL, false); err != nil {
+				if err := p.parseCSS(buffer.NewReader(data), reqURL, false, tagRef.in(tagName, "").at(tokenOffset)); err != nil {
 					return err
 				}
 			} else if tag == html.Iframe {
-				if err := p.parseHTML(buffer.NewReader(data), reqURL); err != nil {
+				if err := p.parseHTML(buffer.NewReader(data), reqURL, tagRef.in(tagName, "").at(tokenOffset)); err != nil {
+					return err
+				}
+			} else if tag == html.Noscript && noscriptDepth > 0 {
+				// lexers that treat noscript as raw text
+				if err := p.parseHTML(buffer.NewReader(data), reqURL, cur.at(tokenOffset)); err != nil {
 					return err
 				}
 			}
@@ -138,20 +287,56 @@ func (p *Parser) parseHTML(r io.Reader, reqURL *url.URL) error {
 	}
 }
 
-func parseSrcset(b []byte) []string {
+// attrValue returns an attribute value without quotes and surrounding whitespace, and its offset in the raw value.
+func attrValue(raw []byte) ([]byte, int64) {
+	if len(raw) > 1 && (raw[0] == '"' || raw[0] == '\'') {
+		val := raw[1 : len(raw)-1]
+		offset := 0
+		for offset < len(val) && parse.IsWhitespace(val[offset]) {
+			offset++
+		}
+		return parse.TrimWhitespace(val), int64(1 + offset)
+	}
+	return raw, 0
+}
+
+// isHeadContent returns true for the elements that may appear in the head of a document.
+func isHeadContent(tag html.Hash) bool {
+	switch tag {
+	case html.Html, html.Base, html.Link, html.Meta, html.Noscript, html.Script, html.Style, html.Template, html.Title:
+		return true
+	}
+	return false
+}
+
+// htmlContext returns the context of an element inside the given number of template and noscript elements.
+func htmlContext(context Context, templateDepth, noscriptDepth int) Context {
+	if templateDepth > 0 {
+		return TemplateContext
+	} else if noscriptDepth > 0 && context != TemplateContext {
+		return NoscriptContext
+	}
+	return context
+}
+
+// parseSrcset returns the URIs of the candidates of a srcset attribute and their offsets in b.
+func parseSrcset(b []byte) ([]string, []int) {
 	uris := []string{}
+	offsets := []int{}
 	n := len(b)
 	start := 0
-	for i := 0; i < n; i++ {
-		if b[i] == ',' {
-			uris = append(uris, parseSrcsetCandidate(b[start:i]))
+	for i := 0; i <= n; i++ {
+		if i == n || b[i] == ',' {
+			uri, offset := parseSrcsetCandidate(b[start:i])
+			uris = append(uris, uri)
+			offsets = append(offsets, start+offset)
 			start = i + 1
 		}
 	}
-	return append(uris, parseSrcsetCandidate(b[start:]))
+	return uris, offsets
 }
 
-func parseSrcsetCandidate(b []byte) string {
+func parseSrcsetCandidate(b []byte) (string, int) {
 	n := len(b)
 	start := 0
 	for i := 0; i < n; i++ {
@@ -167,28 +352,102 @@ func parseSrcsetCandidate(b []byte) string {
 			break
 		}
 	}
-	return string(b[start:end])
+	return string(b[start:end]), start
 }
 
-func (p *Parser) parseCSS(r io.Reader, reqURL *url.URL, isInline bool) error {
+type cssAtRule struct {
+	media string // media query list of @media at-rules
+	skip  bool   // media query list does not match the media policy
+}
+
+func (p *Parser) parseCSS(r io.Reader, reqURL *url.URL, isInline bool, ref Resource) error {
+	atRules := []cssAtRule{}
+	skip := 0 // number of nested @media at-rules that do not match the media policy
+
+	// positions are only needed to report errors
+	var positions *cssPositions
+	if p.ErrorHandler != nil && ref.pos != -1 {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r = buffer.NewReader(b)
+		positions = newCSSPositions(b)
+	}
+
 	parser := css.NewParser(r, isInline)
 	for {
-		gt, _, _ := parser.Next()
+		gt, _, data := parser.Next()
+		vals := parser.Values()
+		offsets := positions.find(vals)
 		if gt == css.ErrorGrammar {
 			if parser.Err() == io.EOF {
 				return nil
 			}
 			return parser.Err()
+		} else if gt == css.BeginAtRuleGrammar {
+			atRule := cssAtRule{}
+			if bytes.EqualFold(data, []byte("@media")) {
+				atRule.media = cssValues(vals)
+				if p.MediaPolicy != nil && !p.MediaPolicy(atRule.media) {
+					atRule.skip = true
+					skip++
+				}
+			}
+			atRules = append(atRules, atRule)
+		} else if gt == css.EndAtRuleGrammar {
+			if len(atRules) > 0 {
+				if atRules[len(atRules)-1].skip {
+					skip--
+				}
+				atRules = atRules[:len(atRules)-1]
+			}
+		} else if skip > 0 {
+			continue
+		} else if gt == css.AtRuleGrammar && bytes.EqualFold(data, []byte("@import")) {
+			i := 0
+			for i < len(vals) && vals[i].TokenType == css.WhitespaceToken {
+				i++
+			}
+			if i == len(vals) {
+				continue
+			}
+
+			var url []byte
+			importRef := ref.in("", "@import").at(cssOffset(offsets, i))
+			if vals[i].TokenType == css.URLToken {
+				var urlOffset int
+				url, urlOffset = cssURL(vals[i].Data)
+				importRef = importRef.at(int64(urlOffset))
+			} else if vals[i].TokenType == css.StringToken && len(vals[i].Data) > 1 {
+				url = vals[i].Data[1 : len(vals[i].Data)-1]
+				importRef = importRef.at(1)
+			}
+
+			if media := cssValues(vals[i+1:]); media != "" {
+				importRef.Media = media
+				if p.MediaPolicy != nil && !p.MediaPolicy(media) {
+					continue
+				}
+			}
+			if url != nil {
+				if err := p.parseURL(string(url), reqURL, importRef); err != nil {
+					return err
+				}
+			}
 		} else if gt == css.DeclarationGrammar {
-			vals := parser.Values()
-			for _, val := range vals {
-				if val.TokenType == css.URLToken && len(val.Data) > 5 {
-					url := val.Data[4 : len(val.Data)-1]
-					if len(url) > 2 && (url[0] == '"' || url[0] == '\'') {
-						url = url[1 : len(url)-1]
-					}
-					if !bytes.HasPrefix(url, []byte("data:")) {
-						if err := p.parseURL(string(url), reqURL); err != nil {
+			declRef := ref.in("", string(data))
+			for i := len(atRules) - 1; i >= 0; i-- {
+				if atRules[i].media != "" {
+					declRef.Media = atRules[i].media
+					break
+				}
+			}
+
+			for i, val := range vals {
+				if val.TokenType == css.URLToken {
+					if url, urlOffset := cssURL(val.Data); url != nil && !bytes.HasPrefix(url, []byte("data:")) {
+						if err := p.parseURL(string(url), reqURL, declRef.at(cssOffset(offsets, i)).at(int64(urlOffset))); err != nil {
 							return err
 						}
 					}
@@ -198,12 +457,97 @@ func (p *Parser) parseCSS(r io.Reader, reqURL *url.URL, isInline bool) error {
 	}
 }
 
-func (p *Parser) parseSVG(r io.Reader, reqURL *url.URL) error {
+// cssURL returns the URL of an url() token and its offset in the token, or nil if empty.
+func cssURL(b []byte) ([]byte, int) {
+	if len(b) <= 5 {
+		return nil, 0
+	}
+	start, end := 4, len(b)-1
+	for start < end && parse.IsWhitespace(b[start]) {
+		start++
+	}
+	for start < end && parse.IsWhitespace(b[end-1]) {
+		end--
+	}
+	if end-start > 2 && (b[start] == '"' || b[start] == '\'') {
+		start++
+		end--
+	}
+	return b[start:end], start
+}
+
+// cssPositions holds the offsets of the url() and string tokens of a stylesheet, as the css.Parser does not report positions.
+type cssPositions struct {
+	tokens  []css.Token
+	offsets []int64
+	next    int // index of the next token to match
+}
+
+func newCSSPositions(b []byte) *cssPositions {
+	positions := &cssPositions{}
+	offset := int64(0)
+	lexer := css.NewLexer(buffer.NewReader(b))
+	for {
+		tt, data := lexer.Next()
+		if tt == css.ErrorToken {
+			return positions
+		} else if tt == css.URLToken || tt == css.StringToken {
+			positions.tokens = append(positions.tokens, css.Token{tt, data})
+			positions.offsets = append(positions.offsets, offset)
+		}
+		offset += int64(len(data))
+	}
+}
+
+// find returns the offsets of the url() and string tokens in vals, which are matched in order to the lexed tokens, and -1 for other tokens. It returns nil if positions is nil.
+func (positions *cssPositions) find(vals []css.Token) []int64 {
+	if positions == nil {
+		return nil
+	}
+	offsets := make([]int64, len(vals))
+	for i, val := range vals {
+		offsets[i] = -1
+		if val.TokenType != css.URLToken && val.TokenType != css.StringToken {
+			continue
+		}
+		for j := positions.next; j < len(positions.tokens); j++ {
+			if positions.tokens[j].TokenType == val.TokenType && bytes.Equal(positions.tokens[j].Data, val.Data) {
+				offsets[i] = positions.offsets[j]
+				positions.next = j + 1
+				break
+			}
+		}
+	}
+	return offsets
+}
+
+// cssOffset returns the i-th offset, or -1 if unknown.
+func cssOffset(offsets []int64, i int) int64 {
+	if i < len(offsets) {
+		return offsets[i]
+	}
+	return -1
+}
+
+// cssValues returns the tokens as a string with whitespace collapsed.
+func cssValues(vals []css.Token) string {
+	b := []byte{}
+	for _, val := range vals {
+		b = append(b, val.Data...)
+	}
+	return string(parse.ReplaceMultipleWhitespace(parse.TrimWhitespace(b)))
+}
+
+func (p *Parser) parseSVG(r io.Reader, reqURL *url.URL, ref Resource) error {
 	var tag svg.Hash
+	var tagName string
+	n := int64(0) // offset of the current token in the document
 
 	lexer := xml.NewLexer(r)
 	for {
 		tt, data := lexer.Next()
+		tokenOffset := n
+		n += int64(len(data))
 		switch tt {
 		case xml.ErrorToken:
 			if lexer.Err() == io.EOF {
@@ -212,24 +556,32 @@ func (p *Parser) parseSVG(r io.Reader, reqURL *url.URL) error {
 			return lexer.Err()
 		case xml.StartTagToken:
 			tag = svg.ToHash(lexer.Text())
+			tagName = string(lexer.Text())
 			for {
-				attrTokenType, _ := lexer.Next()
+				attrTokenType, attrData := lexer.Next()
+				n += int64(len(attrData))
 				if attrTokenType != xml.AttributeToken {
 					break
 				}
 
 				if attr := svg.ToHash(lexer.Text()); attr == svg.Style || (tag == svg.Image || tag == svg.Script || tag == svg.FeImage || tag == svg.Color_Profile || tag == svg.Use) && (attr == svg.Href || parse.Equal(lexer.Text(), []byte("xlink:href"))) {
-					attrVal := lexer.AttrVal()
-					if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
-						attrVal = parse.ReplaceMultipleWhitespace(parse.TrimWhitespace(attrVal[1 : len(attrVal)-1]))
+					// the attribute value ends the attribute token
+					attrVal, valOffset := attrValue(lexer.AttrVal())
+					valOffset += n - int64(len(lexer.AttrVal()))
+					if collapsed := parse.ReplaceMultipleWhitespace(attrVal); len(collapsed) != len(attrVal) {
+						attrVal = collapsed
+						if attr == svg.Style {
+							valOffset = -1 // positions in the collapsed value are unknown
+						}
 					}
 
+					attrRef := ref.in(tagName, string(lexer.Text())).at(valOffset)
 					if attr == svg.Style {
-						if err := p.parseCSS(buffer.NewReader(attrVal), reqURL, true); err != nil {
+						if err := p.parseCSS(buffer.NewReader(attrVal), reqURL, true, attrRef); err != nil {
 							return err
 						}
 					} else {
-						if err := p.parseURL(string(attrVal), reqURL); err != nil {
+						if err := p.parseURL(string(attrVal), reqURL, attrRef); err != nil {
 							return err
 						}
 					}
@@ -237,7 +589,7 @@ func (p *Parser) parseSVG(r io.Reader, reqURL *url.URL) error {
 			}
 		case xml.TextToken:
 			if tag == svg.Style {
-				if err := p.parseCSS(buffer.NewReader(data), reqURL, false); err != nil {
+				if err := p.parseCSS(buffer.NewReader(data), reqURL, false, ref.in(tagName, "").at(tokenOffset)); err != nil {
 					return err
 				}
 			}
@@ -246,37 +598,160 @@ func (p *Parser) parseSVG(r io.Reader, reqURL *url.URL) error {
 	}
 }
 
-func (p *Parser) parseURL(rawResURL string, reqURL *url.URL) error {
+// parseXML parses Atom and RSS feeds and sitemaps.
+func (p *Parser) parseXML(r io.Reader, reqURL *url.URL) error {
+	var tag []byte
+	inImage := false
+	n := int64(0) // offset of the current token in the document
+
+	lexer := xml.NewLexer(r)
+	for {
+		tt, data := lexer.Next()
+		tokenOffset := n
+		n += int64(len(data))
+		switch tt {
+		case xml.ErrorToken:
+			if lexer.Err() == io.EOF {
+				return nil
+			}
+			return lexer.Err()
+		case xml.StartTagToken:
+			tag = append(tag[:0], lexer.Text()...)
+			if parse.Equal(tag, []byte("image")) || parse.Equal(tag, []byte("image:image")) {
+				inImage = true
+			}
+
+			var href, rel []byte
+			var hrefOffset int64
+			for {
+				attrTokenType, attrData := lexer.Next()
+				n += int64(len(attrData))
+				if attrTokenType != xml.AttributeToken {
+					break
+				}
+
+				// the attribute value ends the attribute token
+				attr := lexer.Text()
+				attrVal, valOffset := attrValue(lexer.AttrVal())
+				valOffset += n - int64(len(lexer.AttrVal()))
+
+				if parse.Equal(attr, []byte("url")) && (parse.Equal(tag, []byte("enclosure")) || parse.Equal(tag, []byte("media:content")) || parse.Equal(tag, []byte("media:thumbnail"))) || parse.Equal(attr, []byte("href")) && parse.Equal(tag, []byte("itunes:image")) {
+					if err := p.parseURL(string(attrVal), reqURL, Resource{Element: string(tag), Attribute: string(attr), pos: valOffset}); err != nil {
+						return err
+					}
+				} else if parse.Equal(tag, []byte("link")) {
+					if parse.Equal(attr, []byte("href")) {
+						href = append(href[:0], attrVal...)
+						hrefOffset = valOffset
+					} else if parse.Equal(attr, []byte("rel")) {
+						rel = append(rel[:0], attrVal...)
+					}
+				}
+			}
+			if href != nil && parse.Equal(rel, []byte("enclosure")) {
+				if err := p.parseURL(string(href), reqURL, Resource{Element: "link", Attribute: "href", pos: hrefOffset}); err != nil {
+					return err
+				}
+			}
+		case xml.EndTagToken:
+			if parse.Equal(lexer.Text(), []byte("image")) || parse.Equal(lexer.Text(), []byte("image:image")) {
+				inImage = false
+			}
+			tag = tag[:0]
+		case xml.TextToken, xml.CDATAToken:
+			if parse.Equal(tag, []byte("loc")) || parse.Equal(tag, []byte("image:loc")) || parse.Equal(tag, []byte("icon")) || parse.Equal(tag, []byte("logo")) || inImage && parse.Equal(tag, []byte("url")) {
+				text, textOffset := data, tokenOffset
+				if tt == xml.CDATAToken {
+					text = lexer.Text()
+					textOffset += int64(len("<![CDATA["))
+				}
+				for len(text) > 0 && parse.IsWhitespace(text[0]) {
+					text = text[1:]
+					textOffset++
+				}
+				if uri := parse.TrimWhitespace(text); len(uri) > 0 {
+					if err := p.parseURL(string(uri), reqURL, Resource{Element: string(tag), pos: textOffset}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		lexer.Free(len(data))
+	}
+}
+
+func (p *Parser) parseURL(rawResURL string, reqURL *url.URL, ref Resource) error {
 	resURL, err := url.Parse(rawResURL)
 	if err != nil {
 		return err
 	}
 
-	if resURL.Host != "" && p.baseURL.Host != "" && resURL.Host != p.baseURL.Host {
+	if resURL.Scheme != "" && resURL.Scheme != "http" && resURL.Scheme != "https" {
+		return nil // data:, mailto:, javascript:, ...
+	} else if resURL.Host != "" && p.baseURL.Host != "" && resURL.Host != p.baseURL.Host {
+		p.referenceError(ref, resURL.String(), rawResURL, reqURL, ErrOutsideBaseURL)
 		return nil
 	}
 
+	if ref.Context != LiveContext {
+		policy := p.TemplatePolicy
+		if ref.Context == NoscriptContext {
+			policy = p.NoscriptPolicy
+		}
+		if policy == SkipContext {
+			return nil
+		} else if policy == IncludeContext {
+			ref.Context = LiveContext
+		}
+	}
+
 	resolvedURI := reqURL.ResolveReference(resURL)
 	if strings.HasPrefix(resolvedURI.Path, p.baseURL.Path) {
 		uri := resolvedURI.Path
 		if p.IsRecursive() {
 			p.wg.Add(1)
-			go func() {
+			go func(ref Resource) {
 				defer p.wg.Done()
 
 				r, mimetype, err := p.opener.Open(uri)
 				if err != nil {
+					p.referenceError(ref, uri, rawResURL, reqURL, err)
+					return
+				} else if !p.visit(uri) {
+					if closer, ok := r.(io.Closer); ok {
+						closer.Close()
+					}
 					return
 				}
 
-				if err := p.parse(r, mimetype, uri); err != nil {
+				if err := p.parse(r, mimetype, uri, Resource{Context: ref.Context, Media: ref.Media, Offset: ref.Offset}); err != nil {
+					if err != ErrNoParser {
+						p.referenceError(ref, uri, rawResURL, reqURL, err)
+					}
 					return
 				}
-			}()
+			}(ref)
 		}
-		if err = p.uriHandler.URI(uri); err != nil {
+		if resourceHandler, ok := p.uriHandler.(ResourceHandler); ok {
+			ref.URI = uri
+			ref.Referrer = reqURL.String()
+			err = resourceHandler.Resource(ref)
+		} else {
+			err = p.uriHandler.URI(uri)
+		}
+		if err != nil {
 			return err
 		}
+	} else {
+		p.referenceError(ref, resolvedURI.String(), rawResURL, reqURL, ErrOutsideBaseURL)
 	}
 	return nil
 }
+
+func (p *Parser) referenceError(ref Resource, uri, raw string, reqURL *url.URL, err error) {
+	if p.ErrorHandler != nil {
+		ref.URI = uri
+		ref.Referrer = reqURL.String()
+		p.ErrorHandler(&ReferenceError{ref, raw, err})
+	}
+}
@@ -2,7 +2,14 @@ package push
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/tdewolff/test"
@@ -28,6 +35,10 @@ func TestURLParser(t *testing.T) {
 		{"/dir/", "/index.html", "header.jpg", ""},
 		{"/dir/", "/dir/index.html", "header.jpg", "/dir/header.jpg"},
 		{"", "/index.html", "header.jpg", "/header.jpg"},
+		{"example.com/", "/index.html", "ftp://example.com/header.jpg", ""},
+		{"", "/index.html", "file:///header.jpg", ""},
+		{"", "/index.html", "data:image/png;base64,AAAA", ""},
+		{"", "/index.html", "mailto:info@example.com", ""},
 	}
 
 	for _, tt := range urlParserTests {
@@ -41,7 +52,7 @@ func TestURLParser(t *testing.T) {
 		reqURL, err := url.Parse(tt.uri)
 		test.Error(t, err, nil)
 
-		err = parser.parseURL(tt.input, reqURL)
+		err = parser.parseURL(tt.input, reqURL, Resource{})
 		test.Error(t, err, nil)
 		test.String(t, uri, tt.expected, tt.baseURL, tt.uri)
 	}
@@ -73,10 +84,22 @@ func TestParsers(t *testing.T) {
 		{"image/svg+xml", `<color-profile href="/res" xlink:href="/res"></color-profile>`},
 		{"image/svg+xml", `<use href="/res" xlink:href="/res"></use>`},
 
+		{"application/rss+xml", `<enclosure url="/res" length="1" type="audio/mpeg"/>`},
+		{"application/rss+xml", `<media:content url="/res"/>`},
+		{"application/rss+xml", `<image><url>/res</url></image>`},
+		{"application/rss+xml", `<itunes:image href="/res"/>`},
+		{"application/atom+xml", `<link rel="enclosure" href="/res"/>`},
+		{"application/atom+xml", `<logo>/res</logo>`},
+		{"application/xml", `<url><loc>/res</loc></url>`},
+		{"application/xml", `<url><loc><![CDATA[/res]]></loc></url>`},
+		{"application/xml", `<url><image:image><image:loc>/res</image:loc></image:image></url>`},
+
 		// recursive
 		{"text/html", `<style>a { background-image: url("/res"); }</style>`},
 		{"text/html", `<x style="background-image: url('/res');">`},
 		{"text/html", `<iframe><img src="/res"></iframe>`},
+		{"text/html", `<iframe srcdoc="&lt;img src=&quot;/res&quot;&gt;"></iframe>`},
+		{"text/html", `<iframe srcdoc='<p style="background:url(&apos;/res&apos;)">'></iframe>`},
 		{"text/html", `<svg><image href="/res"></image></svg>`},
 
 		{"image/svg+xml", `<style>a { background-image: url("/res"); }</style>`},
@@ -96,3 +119,162 @@ func TestParsers(t *testing.T) {
 		test.Error(t, err, nil)
 	}
 }
+
+func TestXMLParser(t *testing.T) {
+	r := bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?>
+	<feed xmlns="http://www.w3.org/2005/Atom">
+		<link rel="alternate" href="http://example.com/"/>
+		<entry>
+			<link rel="enclosure" href="http://example.com/podcast.mp3"/>
+			<link href="/entry.html"/>
+		</entry>
+	</feed>`)
+
+	uris, err := List("example.com/", nil, r, "application/atom+xml", "/feed.atom")
+	test.Error(t, err, nil)
+	test.String(t, strings.Join(uris, ","), "/podcast.mp3")
+}
+
+type resourceHandler struct {
+	resources []Resource
+	mutex     sync.Mutex
+}
+
+func (h *resourceHandler) URI(uri string) error {
+	return h.Resource(Resource{URI: uri})
+}
+
+func (h *resourceHandler) Resource(res Resource) error {
+	h.mutex.Lock()
+	h.resources = append(h.resources, res)
+	h.mutex.Unlock()
+	return nil
+}
+
+func TestResourceHandler(t *testing.T) {
+	r := bytes.NewBufferString(`<link href="/style.css"><iframe srcdoc="&lt;img src=&quot;image.png&quot;&gt;"></iframe><p style="background:url(bg.png)">`)
+
+	h := &resourceHandler{}
+	parser, err := NewParser("example.com/", nil, h)
+	test.Error(t, err, nil)
+
+	err = parser.Parse(r, "text/html", "/dir/index.html")
+	test.Error(t, err, nil)
+
+	s := []string{}
+	for _, res := range h.resources {
+		s = append(s, res.URI+" "+res.Referrer+" "+res.Element+" "+res.Attribute)
+	}
+	test.String(t, strings.Join(s, ","), "/style.css /dir/index.html link href,/dir/image.png /dir/index.html iframe srcdoc,/dir/bg.png /dir/index.html p style")
+}
+
+func TestContextPolicy(t *testing.T) {
+	input := `<!-- <img src="/comment.png"> -->
+	<template><img src="/template.png"></template>
+	<noscript><img src="/noscript.png"></noscript>
+	<img src="/live.png">`
+
+	policyTests := []struct {
+		templatePolicy ContextPolicy
+		noscriptPolicy ContextPolicy
+		expected       string
+	}{
+		{SkipContext, SkipContext, "/live.png:0"},
+		{IncludeContext, SkipContext, "/template.png:0,/live.png:0"},
+		{SkipContext, IncludeContext, "/noscript.png:0,/live.png:0"},
+		{TagContext, TagContext, "/template.png:1,/noscript.png:2,/live.png:0"},
+	}
+
+	for _, tt := range policyTests {
+		h := &resourceHandler{}
+		parser, err := NewParser("example.com/", nil, h)
+		test.Error(t, err, nil)
+		parser.TemplatePolicy = tt.templatePolicy
+		parser.NoscriptPolicy = tt.noscriptPolicy
+
+		err = parser.Parse(bytes.NewBufferString(input), "text/html", "/index.html")
+		test.Error(t, err, nil)
+
+		s := []string{}
+		for _, res := range h.resources {
+			s = append(s, res.URI+":"+strconv.Itoa(int(res.Context)))
+		}
+		test.String(t, strings.Join(s, ","), tt.expected)
+	}
+}
+
+func TestMediaPolicy(t *testing.T) {
+	mediaTests := []struct {
+		mimetype string
+		input    string
+		expected string
+	}{
+		{"text/html", `<link rel="stylesheet" href="/print.css" media="print"><link rel="stylesheet" media="screen" href="/screen.css">`, "/screen.css:screen"},
+		{"text/html", `<picture><source media="print" srcset="/print.png"><source media="(min-width: 600px)" srcset="/wide.png"></picture>`, "/wide.png:(min-width: 600px)"},
+		{"text/html", `<style media="print">a { background: url(/print.png); }</style><style>a { background: url(/all.png); }</style>`, "/all.png:"},
+		{"text/css", `@import url("/print.css") print; @import "/screen.css" screen and (color); @import url(/all.css);`, "/screen.css:screen and (color),/all.css:"},
+		{"text/css", `@media print { a { background: url(/print.png); } } @media screen { a { background: url(/screen.png); } } a { background: url(/all.png); }`, "/screen.png:screen,/all.png:"},
+		{"text/css", `@media print { @supports (display: grid) { a { background: url(/print.png); } } } @supports (display: grid) { @media screen { a { background: url(/screen.png); } } }`, "/screen.png:screen"},
+	}
+
+	for _, tt := range mediaTests {
+		h := &resourceHandler{}
+		parser, err := NewParser("example.com/", nil, h)
+		test.Error(t, err, nil)
+
+		err = parser.Parse(bytes.NewBufferString(tt.input), tt.mimetype, "/index.html")
+		test.Error(t, err, nil)
+
+		s := []string{}
+		for _, res := range h.resources {
+			s = append(s, res.URI+":"+res.Media)
+		}
+		test.String(t, strings.Join(s, ","), tt.expected, tt.input)
+	}
+}
+
+func TestRecursiveMedia(t *testing.T) {
+	r := bytes.NewBufferString(`<link rel="stylesheet" href="/style.css" media="screen">`)
+	fileOpener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if uri != "/style.css" {
+			return nil, "", errors.New("not found")
+		}
+		return bytes.NewBufferString(`a { background: url(/bg.png); } @media print { a { background: url(/print.png); } }`), "text/css", nil
+	})
+
+	h := &resourceHandler{}
+	parser, err := NewParser("example.com/", fileOpener, h)
+	test.Error(t, err, nil)
+	parser.MediaPolicy = nil
+
+	err = parser.Parse(r, "text/html", "/index.html")
+	test.Error(t, err, nil)
+
+	s := []string{}
+	for _, res := range h.resources {
+		s = append(s, res.URI+":"+res.Media)
+	}
+	sort.Strings(s)
+	test.String(t, strings.Join(s, ","), "/bg.png:screen,/print.png:print,/style.css:screen")
+}
+
+func TestRecursiveCycle(t *testing.T) {
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		switch uri {
+		case "/index.html":
+			return strings.NewReader(`<link rel="canonical" href="/index.html"><link rel="stylesheet" href="/a.css">`), "text/html", nil
+		case "/a.css":
+			return strings.NewReader(`@import "b.css";`), "text/css", nil
+		case "/b.css":
+			return strings.NewReader(`@import "a.css";`), "text/css", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	r, mimetype, _ := opener.Open("/index.html")
+	g, err := ParseGraph("", opener, r, mimetype, "/index.html")
+	test.Error(t, err, nil)
+	_, err = g.TopologicalOrder()
+	test.Error(t, err, ErrCycle)
+	test.String(t, strings.Join(g.TransitiveDeps("/a.css"), ","), "/b.css")
+}
@@ -0,0 +1,67 @@
+package push
+
+import "strings"
+
+// Context is the HTML context in which a resource was found.
+type Context int
+
+const (
+	LiveContext     Context = iota // used when the document is rendered
+	TemplateContext                // inside <template>, inert until cloned
+	NoscriptContext                // inside <noscript>, unused when scripting is enabled
+)
+
+func (c Context) String() string {
+	switch c {
+	case TemplateContext:
+		return "template"
+	case NoscriptContext:
+		return "noscript"
+	}
+	return "live"
+}
+
+// ContextPolicy specifies how the parser handles resources found in a template or noscript context.
+type ContextPolicy int
+
+const (
+	SkipContext    ContextPolicy = iota // resources are not reported
+	IncludeContext                      // resources are reported as LiveContext
+	TagContext                          // resources are reported with their Context to ResourceHandlers
+)
+
+// MediaPolicy reports whether resources that only apply to the media query list are handled.
+type MediaPolicy func(media string) bool
+
+// DefaultMediaPolicy is the default MediaPolicy of a Parser.
+var DefaultMediaPolicy MediaPolicy = ScreenMedia
+
+// ScreenMedia is a MediaPolicy that matches media query lists that may apply to a screen. It skips resources for print-only or otherwise non-screen media.
+func ScreenMedia(media string) bool {
+	if strings.TrimSpace(media) == "" {
+		return true
+	}
+	for _, query := range strings.Split(strings.ToLower(media), ",") {
+		fields := strings.Fields(strings.Replace(query, "(", " (", 1))
+		not := false
+		if len(fields) > 0 && fields[0] == "only" {
+			fields = fields[1:]
+		} else if len(fields) > 0 && fields[0] == "not" {
+			not = true
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		mediaType, hasFeatures := "all", true
+		if fields[0][0] != '(' {
+			mediaType, hasFeatures = fields[0], len(fields) > 1
+		}
+		isScreen := mediaType == "all" || mediaType == "screen"
+		if isScreen != not || not && hasFeatures {
+			return true
+		}
+	}
+	return false
+}
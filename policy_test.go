@@ -0,0 +1,34 @@
+package push
+
+import (
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestScreenMedia(t *testing.T) {
+	mediaTests := []struct {
+		media    string
+		expected bool
+	}{
+		{"", true},
+		{"all", true},
+		{"screen", true},
+		{"SCREEN", true},
+		{"only screen and (min-width: 600px)", true},
+		{"(min-width: 600px)", true},
+		{"screen and(max-width:600px)", true},
+		{"print", false},
+		{"print and (orientation: landscape)", false},
+		{"speech", false},
+		{"print, screen", true},
+		{"print, speech", false},
+		{"not print", true},
+		{"not screen", false},
+		{"not screen and (color)", true},
+	}
+
+	for _, tt := range mediaTests {
+		test.That(t, ScreenMedia(tt.media) == tt.expected, tt.media)
+	}
+}
@@ -0,0 +1,99 @@
+package push
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// PrecacheEntry is a file in a PrecacheManifest.
+type PrecacheEntry struct {
+	URL      string `json:"url"`
+	Revision string `json:"revision"` // MD5 hash of the contents
+}
+
+// PrecacheManifest is a list of files for a service worker to precache, compatible with the precache manifests of Workbox.
+type PrecacheManifest []PrecacheEntry
+
+// NewPrecacheManifest parses the pages with uris and the local resources they reference recursively, and returns a PrecacheManifest with the pages and all their resources in order of discovery. The revision of each file is the hash of its contents as read by opener. Files that cannot be opened or that are larger than maxSize bytes are skipped, a maxSize of zero or less means no limit.
+func NewPrecacheManifest(baseURL string, opener FileOpener, uris []string, maxSize int64) (PrecacheManifest, error) {
+	g := NewGraph()
+	for _, uri := range uris {
+		r, mimetype, err := opener.Open(uri)
+		if err != nil {
+			return nil, err
+		}
+		if err = g.Parse(baseURL, opener, r, mimetype, uri); err != nil && err != ErrNoParser {
+			return nil, err
+		}
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	m := PrecacheManifest{}
+	seen := map[string]bool{}
+	for _, page := range uris {
+		for _, uri := range append([]string{page}, g.TransitiveDeps(page)...) {
+			if seen[uri] {
+				continue
+			}
+			seen[uri] = true
+
+			revision, ok, err := precacheRevision(opener, uri, maxSize)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				m = append(m, PrecacheEntry{uri, revision})
+			}
+		}
+	}
+	return m, nil
+}
+
+// precacheRevision returns the hash of the contents of uri, or false if it cannot be opened or is larger than maxSize.
+func precacheRevision(opener FileOpener, uri string, maxSize int64) (string, bool, error) {
+	r, _, err := opener.Open(uri)
+	if err != nil {
+		return "", false, nil
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	hash := md5.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return "", false, err
+	} else if maxSize > 0 && n > maxSize {
+		return "", false, nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), true, nil
+}
+
+// WriteJSON writes the manifest as indented JSON.
+func (m PrecacheManifest) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteModule writes the manifest as a JavaScript module that exports it as default, to be imported by a service worker.
+func (m PrecacheManifest) WriteModule(w io.Writer) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, "export default "); err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, ";\n"...))
+	return err
+}
@@ -0,0 +1,49 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestPrecacheManifest(t *testing.T) {
+	files := map[string]string{
+		"/index.html": `<link rel="stylesheet" href="/style.css"><img src="/large.png"><img src="/missing.png">`,
+		"/about.html": `<link rel="stylesheet" href="/style.css">`,
+		"/style.css":  `a { background: url(/bg.png); }`,
+		"/bg.png":     `png`,
+		"/large.png":  strings.Repeat("a", 1000),
+	}
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if content, ok := files[uri]; ok {
+			return strings.NewReader(content), ExtToMimetype[uri[strings.LastIndexByte(uri, '.'):]], nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	m, err := NewPrecacheManifest("", opener, []string{"/index.html", "/about.html"}, 100)
+	test.Error(t, err, nil)
+
+	urls := []string{}
+	for _, entry := range m {
+		urls = append(urls, entry.URL)
+	}
+	test.String(t, strings.Join(urls, ","), "/index.html,/style.css,/bg.png,/about.html")
+	test.String(t, m[2].Revision, "bff139fa05ac583f685a523ab3d110a0") // md5 of "png"
+
+	buf := &bytes.Buffer{}
+	test.Error(t, m[2:3].WriteJSON(buf), nil)
+	test.String(t, buf.String(), "[\n\t{\n\t\t\"url\": \"/bg.png\",\n\t\t\"revision\": \"bff139fa05ac583f685a523ab3d110a0\"\n\t}\n]\n")
+
+	buf.Reset()
+	test.Error(t, m[2:3].WriteModule(buf), nil)
+	test.String(t, buf.String(), "export default [\n\t{\n\t\t\"url\": \"/bg.png\",\n\t\t\"revision\": \"bff139fa05ac583f685a523ab3d110a0\"\n\t}\n];\n")
+
+	m, err = NewPrecacheManifest("", opener, []string{"/index.html"}, 0)
+	test.Error(t, err, nil)
+	test.That(t, len(m) == 4, "no size limit")
+}
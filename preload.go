@@ -0,0 +1,148 @@
+package push
+
+import (
+	entity "html"
+	"io"
+	"net/http"
+	"path"
+)
+
+// DefaultPreloadMarker is the marker before which PreloadWriter inserts the preload elements.
+var DefaultPreloadMarker = "</head>"
+
+// maxPreloadBuffer is the number of bytes buffered while looking for the marker, after which the document is written unchanged.
+const maxPreloadBuffer = 64 * 1024
+
+type preloadingWriter struct {
+	w        io.Writer
+	elements []byte
+	marker   []byte
+
+	buf  []byte
+	done bool // marker was found or the buffer was exceeded
+}
+
+// PreloadWriter wraps an io.Writer that inserts a <link rel="preload"> element for each URI right before the first occurrence of marker in an HTML document, such as DefaultPreloadMarker. The marker is matched case-insensitively. Everything up to the marker is buffered and the rest is written through unchanged. If the marker is not found within the first 64kB, the document is written unchanged.
+// The request destination of the URIs is determined by ResourceKind. The writer must be closed explicitly.
+func PreloadWriter(w io.Writer, uris []string, marker string) *preloadingWriter {
+	elements := []byte{}
+	for _, uri := range uris {
+		as := manifestType(Resource{URI: uri})
+		elements = append(elements, `<link rel="preload" href="`...)
+		elements = append(elements, entity.EscapeString(uri)...)
+		elements = append(elements, `" as="`...)
+		elements = append(elements, as...)
+		if as == "font" {
+			elements = append(elements, `" crossorigin>`...)
+		} else {
+			elements = append(elements, `">`...)
+		}
+	}
+	lowerMarker := []byte(marker)
+	for i, c := range lowerMarker {
+		lowerMarker[i] = lowerASCII(c)
+	}
+	return &preloadingWriter{w, elements, lowerMarker, []byte{}, len(elements) == 0}
+}
+
+func (w *preloadingWriter) Write(b []byte) (int, error) {
+	if w.done {
+		return w.w.Write(b)
+	}
+
+	// search from where the marker may start in the buffer
+	start := len(w.buf) - len(w.marker) + 1
+	if start < 0 {
+		start = 0
+	}
+	w.buf = append(w.buf, b...)
+	if i := indexASCIIFold(w.buf[start:], w.marker); i != -1 {
+		i += start
+		w.done = true
+		if _, err := w.w.Write(w.buf[:i]); err != nil {
+			return 0, err
+		}
+		if _, err := w.w.Write(w.elements); err != nil {
+			return 0, err
+		}
+		if _, err := w.w.Write(w.buf[i:]); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	} else if len(w.buf) > maxPreloadBuffer {
+		w.done = true
+		if _, err := w.w.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	}
+	return len(b), nil
+}
+
+// Close writes the buffered document unchanged if the marker was not found.
+func (w *preloadingWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	_, err := w.w.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// indexASCIIFold returns the index of the first occurrence of the lowercase sep in b, matching ASCII letters case-insensitively, or -1 if not present. Unlike bytes.ToLower, other bytes are left as is so that the index is that in b.
+func indexASCIIFold(b, sep []byte) int {
+	for i := 0; i+len(sep) <= len(b); i++ {
+		j := 0
+		for j < len(sep) && lowerASCII(b[i+j]) == sep[j] {
+			j++
+		}
+		if j == len(sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+////////////////
+
+// PreloadResponseWriter wraps a ResponseWriter interface. Instead of pushing, it inserts <link rel="preload"> elements before the </head> of HTML responses for the styles, scripts and fonts of the cache entry of the request. If the request is not cached, the response is parsed to set the cache entry for subsequent requests.
+// Cache must not be nil. The writer must be closed explicitly.
+func (p *P) PreloadResponseWriter(w http.ResponseWriter, r *http.Request) (ResponseWriterCloser, error) {
+	if p.cache == nil {
+		return &nopResponseWriter{w}, nil
+	}
+
+	key := p.CacheKey(r)
+	mimetype, _ := ExtToMimetype[path.Ext(r.URL.Path)]
+	if resources, ok := p.cache.Get(key); ok {
+		uris := []string{}
+		for _, uri := range resources {
+			if kind := ResourceKind(Resource{URI: uri}); kind == StyleKind || kind == ScriptKind || kind == FontKind {
+				uris = append(uris, uri)
+			}
+		}
+		return &htmlResponseWriter{w, mimetype, func(w io.Writer) io.WriteCloser {
+			return PreloadWriter(w, uris, DefaultPreloadMarker)
+		}, nil, false}, nil
+	}
+
+	listHandler := NewListHandler()
+	parser, err := NewParser(p.baseURL, p.opener, listHandler)
+	if err != nil {
+		return &nopResponseWriter{w}, err
+	}
+	onClose := func(parsed bool, _ string) {
+		if parsed {
+			p.cache.Set(key, listHandler.URIs)
+		}
+	}
+	return &pushingResponseWriter{w, nil, parser, mimetype, r.RequestURI, false, false, nil, false, nil, "", nil, false, onClose}, nil
+}
@@ -0,0 +1,70 @@
+package push
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestPreloadWriter(t *testing.T) {
+	var preloadTests = []struct {
+		writes   []string
+		expected string
+	}{
+		{[]string{`<html><head><title>x</title></head><body></body></html>`}, `<html><head><title>x</title><link rel="preload" href="/style.css" as="style"><link rel="preload" href="/font.woff2" as="font" crossorigin><link rel="preload" href="/a&amp;b.js" as="script"></head><body></body></html>`},
+		{[]string{`<html><head></he`, `ad><body>`, `</body>`}, `<html><head><link rel="preload" href="/style.css" as="style"><link rel="preload" href="/font.woff2" as="font" crossorigin><link rel="preload" href="/a&amp;b.js" as="script"></head><body></body>`},
+		{[]string{`<HEAD></HEAD>`}, `<HEAD><link rel="preload" href="/style.css" as="style"><link rel="preload" href="/font.woff2" as="font" crossorigin><link rel="preload" href="/a&amp;b.js" as="script"></HEAD>`},
+		{[]string{`<p>no head</p>`}, `<p>no head</p>`},
+		{[]string{`<head><title>İİ</title></HeAd>`}, `<head><title>İİ</title><link rel="preload" href="/style.css" as="style"><link rel="preload" href="/font.woff2" as="font" crossorigin><link rel="preload" href="/a&amp;b.js" as="script"></HeAd>`},
+	}
+	for _, tt := range preloadTests {
+		t.Run(tt.expected, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := PreloadWriter(buf, []string{"/style.css", "/font.woff2", "/a&b.js"}, DefaultPreloadMarker)
+			for _, s := range tt.writes {
+				n, err := w.Write([]byte(s))
+				test.Error(t, err, nil)
+				test.That(t, n == len(s), "written bytes")
+			}
+			test.Error(t, w.Close(), nil)
+			test.String(t, buf.String(), tt.expected)
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	w := PreloadWriter(buf, []string{"/style.css"}, DefaultPreloadMarker)
+	w.Write(bytes.Repeat([]byte("a"), maxPreloadBuffer+1))
+	test.That(t, buf.Len() == maxPreloadBuffer+1, "buffer exceeded")
+	w.Write([]byte("</head>"))
+	test.Error(t, w.Close(), nil)
+	test.That(t, buf.Len() == maxPreloadBuffer+8, "written unchanged")
+}
+
+func TestPreloadResponseWriter(t *testing.T) {
+	cache := NewDefaultCache()
+	p := New("", nil, cache)
+	html := `<html><head></head><body><img src="/image.png"><link rel="stylesheet" href="/style.css"></body></html>`
+
+	// miss, parse to set cache entry
+	w := httptest.NewRecorder()
+	pw, err := p.PreloadResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(html))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, w.Body.String(), html)
+	_, ok := cache.Get("/")
+	test.That(t, ok)
+
+	// hit, only critical resources are preloaded
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", "100")
+	pw, err = p.PreloadResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(html))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, w.Body.String(), `<html><head><link rel="preload" href="/style.css" as="style"></head><body><img src="/image.png"><link rel="stylesheet" href="/style.css"></body></html>`)
+	test.String(t, w.Header().Get("Content-Length"), "")
+}
@@ -0,0 +1,160 @@
+package push
+
+import (
+	"sort"
+	"sync"
+)
+
+// Priority is the order in which resources are pushed, lower priorities are pushed first.
+type Priority int
+
+// Priority values.
+const (
+	CriticalPriority Priority = iota // stylesheets and synchronous scripts in <head>
+	FontPriority
+	VisiblePriority // images above the fold
+	DefaultPriority
+)
+
+func (p Priority) String() string {
+	switch p {
+	case CriticalPriority:
+		return "critical"
+	case FontPriority:
+		return "font"
+	case VisiblePriority:
+		return "visible"
+	}
+	return "default"
+}
+
+// Weight returns the HTTP/2 stream weight between 1 and 256 of the priority, as used in a PushManifest.
+func (p Priority) Weight() int {
+	switch p {
+	case CriticalPriority:
+		return 256
+	case FontPriority:
+		return 220
+	case VisiblePriority:
+		return 183
+	}
+	return 147
+}
+
+// DefaultPushWindow is the default number of resources that ResponseWriter buffers to push them in order of priority. It is zero, because buffered resources are only pushed once the window is full or the response is done, which delays the pushes of small documents.
+var DefaultPushWindow = 0
+
+// AboveTheFold is the byte offset in a document before which images that are not loaded lazily are considered above the fold.
+var AboveTheFold int64 = 16 * 1024
+
+// ResourcePriority returns the priority of a resource. Stylesheets and synchronous scripts in <head> are critical, followed by fonts and images above the fold, see AboveTheFold.
+func ResourcePriority(res Resource) Priority {
+	switch ResourceKind(res) {
+	case StyleKind:
+		return CriticalPriority
+	case ScriptKind:
+		if res.Head && !res.Deferred {
+			return CriticalPriority
+		}
+	case FontKind:
+		return FontPriority
+	case ImageKind:
+		if !res.Deferred && 0 <= res.Offset && res.Offset < AboveTheFold {
+			return VisiblePriority
+		}
+	}
+	return DefaultPriority
+}
+
+// SortResources sorts resources by priority and then by their offset in the document, resources of equal priority and offset keep their order.
+func SortResources(resources []Resource) {
+	sort.Stable(byPriority{resources, resourcePriorities(resources)})
+}
+
+func resourcePriorities(resources []Resource) []Priority {
+	priorities := make([]Priority, len(resources))
+	for i, res := range resources {
+		priorities[i] = ResourcePriority(res)
+	}
+	return priorities
+}
+
+type byPriority struct {
+	resources  []Resource
+	priorities []Priority
+}
+
+func (a byPriority) Len() int {
+	return len(a.resources)
+}
+
+func (a byPriority) Swap(i, j int) {
+	a.resources[i], a.resources[j] = a.resources[j], a.resources[i]
+	a.priorities[i], a.priorities[j] = a.priorities[j], a.priorities[i]
+}
+
+func (a byPriority) Less(i, j int) bool {
+	if a.priorities[i] != a.priorities[j] {
+		return a.priorities[i] < a.priorities[j]
+	}
+	return a.resources[i].Offset < a.resources[j].Offset
+}
+
+////////////////
+
+// PriorityHandler is a ResourceHandler that buffers up to window resources and passes them to the next URIHandler in order of priority. Flush must be called after parsing to pass the remaining resources.
+type PriorityHandler struct {
+	next   URIHandler
+	window int
+
+	queue []Resource
+	mutex sync.Mutex
+}
+
+// NewPriorityHandler returns a new PriorityHandler.
+func NewPriorityHandler(next URIHandler, window int) *PriorityHandler {
+	return &PriorityHandler{next, window, []Resource{}, sync.Mutex{}}
+}
+
+func (h *PriorityHandler) URI(uri string) error {
+	return h.Resource(Resource{URI: uri, Offset: -1})
+}
+
+// Resource buffers res and passes on the resource of highest priority when the window is full.
+func (h *PriorityHandler) Resource(res Resource) error {
+	h.mutex.Lock()
+	h.queue = append(h.queue, res)
+	if len(h.queue) <= h.window {
+		h.mutex.Unlock()
+		return nil
+	}
+	SortResources(h.queue)
+	res = h.queue[0]
+	h.queue = h.queue[1:]
+	h.mutex.Unlock()
+
+	return h.handle(res)
+}
+
+// Flush passes the buffered resources in order of priority.
+func (h *PriorityHandler) Flush() error {
+	h.mutex.Lock()
+	SortResources(h.queue)
+	queue := h.queue
+	h.queue = []Resource{}
+	h.mutex.Unlock()
+
+	for _, res := range queue {
+		if err := h.handle(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *PriorityHandler) handle(res Resource) error {
+	if next, ok := h.next.(ResourceHandler); ok {
+		return next.Resource(res)
+	}
+	return h.next.URI(res.URI)
+}
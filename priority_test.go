@@ -0,0 +1,99 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestResourcePriority(t *testing.T) {
+	r := bytes.NewBufferString(`<html><head><script src="/app.js"></script><script src="/async.js" async></script><link rel="stylesheet" href="/style.css"></head><body><img src="/logo.png"><img src="/lazy.png" loading="lazy"><script src="/footer.js"></script><p style="src:url(/font.woff2)"></body></html>`)
+	h := &resourceHandler{}
+	parser, err := NewParser("", nil, h)
+	test.Error(t, err, nil)
+	test.Error(t, parser.Parse(r, "text/html", "/index.html"), nil)
+
+	priorities := []string{}
+	for _, res := range h.resources {
+		priorities = append(priorities, res.URI+":"+ResourcePriority(res).String())
+	}
+	test.String(t, strings.Join(priorities, ","), "/app.js:critical,/async.js:default,/style.css:critical,/logo.png:visible,/lazy.png:default,/footer.js:default,/font.woff2:font")
+
+	test.That(t, h.resources[0].Offset < h.resources[1].Offset, "offsets increase")
+	test.That(t, h.resources[0].Head && !h.resources[3].Head, "head")
+	test.That(t, h.resources[1].Deferred && !h.resources[0].Deferred, "deferred")
+
+	logo := h.resources[3]
+	logo.Offset = AboveTheFold
+	test.That(t, ResourcePriority(logo) == DefaultPriority, "image below the fold")
+}
+
+func TestPriorityHandler(t *testing.T) {
+	resources := []Resource{
+		{URI: "/a.png", Element: "img", Attribute: "src", Offset: 100000},
+		{URI: "/b.png", Element: "img", Attribute: "src", Offset: 10},
+		{URI: "/style.css", Element: "link", Attribute: "href", Offset: 20},
+		{URI: "/font.woff2", Element: "src", Offset: 30},
+	}
+
+	var windowTests = []struct {
+		window   int
+		expected string
+	}{
+		{0, "/a.png,/b.png,/style.css,/font.woff2"},
+		{1, "/b.png,/style.css,/font.woff2,/a.png"},
+		{4, "/style.css,/font.woff2,/b.png,/a.png"},
+	}
+	for _, tt := range windowTests {
+		t.Run(strconv.Itoa(tt.window), func(t *testing.T) {
+			list := NewListHandler()
+			h := NewPriorityHandler(list, tt.window)
+			for _, res := range resources {
+				test.Error(t, h.Resource(res), nil)
+			}
+			test.Error(t, h.Flush(), nil)
+			test.String(t, strings.Join(list.URIs, ","), tt.expected)
+		})
+	}
+}
+
+func TestResponseWriterPriority(t *testing.T) {
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		if uri == "/style.css" {
+			return strings.NewReader(`@font-face{src:url(/font.woff2)}`), "text/css", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	request := func(p *P, doc string) string {
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+		test.Error(t, err, nil)
+		pw.Write([]byte(doc))
+		test.Error(t, pw.Close(), nil)
+		return strings.Join(w.URIs, ",")
+	}
+
+	p := New("", opener, NewDefaultCache())
+	p.PushWindow = 8
+	doc := `<head><link rel="stylesheet" href="/style.css"></head><body><img src="/lazy.png" loading="lazy"><img src="/logo.png"><script src="/app.js" defer></script></body>`
+	expected := "/style.css,/font.woff2,/logo.png,/lazy.png,/app.js"
+	for i := 0; i < 2; i++ {
+		test.String(t, request(p, doc), expected, "pushed resources of request", i)
+	}
+	resources, _ := p.cache.Get("/")
+	test.String(t, strings.Join(resources, ","), expected, "cached in order of priority")
+
+	// by default resources are pushed as soon as they are found, but cached in order of priority
+	p = New("", opener, NewDefaultCache())
+	doc = `<link rel="stylesheet" href="/style.css"><script src="/head.js"></script><img src="/logo.png"><iframe srcdoc="<script src=/frame.js></script>"></iframe><script src="/body.js"></script>`
+	expected = "/style.css,/head.js,/font.woff2,/logo.png,/frame.js,/body.js"
+	test.That(t, request(p, doc) != "", "pushed resources of first request")
+	test.String(t, request(p, doc), expected, "head ends at the first element that is not head content")
+}
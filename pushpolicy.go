@@ -0,0 +1,210 @@
+package push
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PushResource is a resource that may be pushed for a request. Cached resources only have a URI and an Offset of -1.
+type PushResource struct {
+	Resource
+	size *lazySize
+}
+
+// NewPushResource returns a PushResource of res with a known size in bytes, or -1 if unknown.
+func NewPushResource(res Resource, size int64) PushResource {
+	return PushResource{res, &lazySize{n: size}}
+}
+
+// Size returns the size in bytes as opened by the FileOpener, or -1 if unknown. It is only determined when called, so that policies that do not need it do not open the file.
+func (res PushResource) Size() int64 {
+	if res.size == nil {
+		return -1
+	}
+	return res.size.get()
+}
+
+// lazySize is a size that is computed once when first needed.
+type lazySize struct {
+	f    func() int64
+	n    int64
+	once sync.Once
+}
+
+func (s *lazySize) get() int64 {
+	s.once.Do(func() {
+		if s.f != nil {
+			s.n = s.f()
+		}
+	})
+	return s.n
+}
+
+// PushPolicy decides which resources are pushed for a request. It is consulted by ResponseWriter for each resource in order of discovery, with pushed the resources already pushed for the request.
+type PushPolicy interface {
+	Push(r *http.Request, res PushResource, pushed []PushResource) bool
+}
+
+// PushPolicyFunc is an adapter to allow the use of ordinary functions as PushPolicy.
+type PushPolicyFunc func(*http.Request, PushResource, []PushResource) bool
+
+// Push calls f(r, res, pushed).
+func (f PushPolicyFunc) Push(r *http.Request, res PushResource, pushed []PushResource) bool {
+	return f(r, res, pushed)
+}
+
+// PushPolicies returns a PushPolicy that pushes a resource only when all policies push it.
+func PushPolicies(policies ...PushPolicy) PushPolicy {
+	return PushPolicyFunc(func(r *http.Request, res PushResource, pushed []PushResource) bool {
+		for _, policy := range policies {
+			if !policy.Push(r, res, pushed) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// KindPolicy returns a PushPolicy that only pushes resources of the given kinds, see ResourceKind. Use KindPolicy(StyleKind, ScriptKind, FontKind) to push only render-blocking resources.
+func KindPolicy(kinds ...Kind) PushPolicy {
+	return PushPolicyFunc(func(_ *http.Request, res PushResource, _ []PushResource) bool {
+		kind := ResourceKind(res.Resource)
+		for _, k := range kinds {
+			if kind == k {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MaxCountPolicy returns a PushPolicy that pushes at most n resources per request.
+func MaxCountPolicy(n int) PushPolicy {
+	return PushPolicyFunc(func(_ *http.Request, _ PushResource, pushed []PushResource) bool {
+		return len(pushed) < n
+	})
+}
+
+// MaxBytesPolicy returns a PushPolicy that pushes resources as long as their total size does not exceed n bytes per request. Resources of unknown size are not pushed.
+func MaxBytesPolicy(n int64) PushPolicy {
+	return PushPolicyFunc(func(_ *http.Request, res PushResource, pushed []PushResource) bool {
+		size := res.Size()
+		if size < 0 {
+			return false
+		}
+		total := size
+		for _, prev := range pushed {
+			total += prev.Size()
+		}
+		return total <= n
+	})
+}
+
+// ExcludePolicy returns a PushPolicy that does not push resources of which the URI path matches any of the patterns. Patterns use the syntax of path.Match, such as /img/*.
+func ExcludePolicy(patterns ...string) PushPolicy {
+	return PushPolicyFunc(func(_ *http.Request, res PushResource, _ []PushResource) bool {
+		uri := res.URI
+		if i := strings.IndexAny(uri, "?#"); i != -1 {
+			uri = uri[:i]
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, uri); ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// FirstBytesPolicy returns a PushPolicy that only pushes resources referenced within the first k bytes of the response. Cached resources have the offset at which they were found, see MaxOffsetKeys. Resources of unknown offset are pushed.
+func FirstBytesPolicy(k int64) PushPolicy {
+	return PushPolicyFunc(func(_ *http.Request, res PushResource, _ []PushResource) bool {
+		return res.Offset <= k
+	})
+}
+
+////////////////
+
+// policyHandler is a ResourceHandler that pushes the resources that are allowed by a PushPolicy.
+type policyHandler struct {
+	policy  PushPolicy
+	r       *http.Request
+	infos   *resourceInfos
+	offsets map[string]int64 // offsets of the cached resources of the request, may be nil
+	pusher  URIHandler
+
+	pushed []PushResource
+	mutex  sync.Mutex
+}
+
+// URI pushes a cached resource with its offset when it was cached, or -1 if unknown.
+func (h *policyHandler) URI(uri string) error {
+	offset, ok := h.offsets[uri]
+	if !ok {
+		offset = -1
+	}
+	return h.Resource(Resource{URI: uri, Offset: offset})
+}
+
+// Resource pushes a resource found while parsing the response.
+func (h *policyHandler) Resource(res Resource) error {
+	pushRes := PushResource{res, &lazySize{f: func() int64 {
+		return h.infos.size(res.URI)
+	}}}
+
+	h.mutex.Lock()
+	push := h.policy.Push(h.r, pushRes, h.pushed)
+	if push {
+		h.pushed = append(h.pushed, pushRes)
+	}
+	h.mutex.Unlock()
+
+	if !push {
+		return nil
+	}
+	return h.pusher.URI(res.URI) // outside the lock, so that concurrent parsers are not serialized by the pushes
+}
+
+////////////////
+
+// MaxOffsetKeys is the maximum number of cache keys of which the offsets of the cached resources are kept when PushPolicy is set, so that policies receive them for cache hits.
+var MaxOffsetKeys = 1024
+
+// setOffsets keeps the offsets of the resources cached for key, or forgets them if resources is nil. It does nothing if PushPolicy is nil.
+func (p *P) setOffsets(key string, resources []Resource) {
+	if p.PushPolicy == nil {
+		return
+	}
+
+	var offsets map[string]int64
+	if resources != nil {
+		offsets = make(map[string]int64, len(resources))
+		for _, res := range resources {
+			if offset, ok := offsets[res.URI]; !ok || offset == -1 || res.Offset != -1 && res.Offset < offset {
+				offsets[res.URI] = res.Offset
+			}
+		}
+	}
+
+	p.offsetsMutex.Lock()
+	defer p.offsetsMutex.Unlock()
+	if offsets == nil {
+		delete(p.offsets, key)
+		return
+	} else if _, ok := p.offsets[key]; !ok && len(p.offsets) >= MaxOffsetKeys {
+		for evict := range p.offsets {
+			delete(p.offsets, evict)
+			break
+		}
+	}
+	p.offsets[key] = offsets
+}
+
+// cachedOffsets returns the offsets of the resources cached for key, or nil if unknown. The map must not be modified.
+func (p *P) cachedOffsets(key string) map[string]int64 {
+	p.offsetsMutex.RLock()
+	defer p.offsetsMutex.RUnlock()
+	return p.offsets[key]
+}
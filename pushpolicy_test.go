@@ -0,0 +1,120 @@
+package push
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestPushPolicy(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	resources := []PushResource{
+		NewPushResource(Resource{URI: "/style.css", Element: "link", Attribute: "href", Offset: 10}, 100),
+		NewPushResource(Resource{URI: "/img/logo.png", Element: "img", Attribute: "src", Offset: 20}, 200),
+		NewPushResource(Resource{URI: "/app.js?v=1", Element: "script", Attribute: "src", Offset: 30}, 300),
+		NewPushResource(Resource{URI: "/font.woff2", Element: "src", Offset: -1}, -1),
+	}
+
+	var policyTests = []struct {
+		name     string
+		policy   PushPolicy
+		expected string
+	}{
+		{"kind", KindPolicy(StyleKind, ScriptKind, FontKind), "/style.css,/app.js?v=1,/font.woff2"},
+		{"count", MaxCountPolicy(2), "/style.css,/img/logo.png"},
+		{"bytes", MaxBytesPolicy(400), "/style.css,/img/logo.png"},
+		{"exclude", ExcludePolicy("/img/*", "/app.js"), "/style.css,/font.woff2"},
+		{"first", FirstBytesPolicy(20), "/style.css,/img/logo.png,/font.woff2"},
+		{"policies", PushPolicies(KindPolicy(StyleKind, ScriptKind), MaxCountPolicy(1)), "/style.css"},
+	}
+	for _, tt := range policyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			pushed := []PushResource{}
+			uris := []string{}
+			for _, res := range resources {
+				if tt.policy.Push(r, res, pushed) {
+					pushed = append(pushed, res)
+					uris = append(uris, res.URI)
+				}
+			}
+			test.String(t, strings.Join(uris, ","), tt.expected)
+		})
+	}
+}
+
+func TestResponseWriterPushPolicy(t *testing.T) {
+	scriptOpens := int32(0)
+	opener := FileOpenerFunc(func(uri string) (io.Reader, string, error) {
+		switch uri {
+		case "/style.css":
+			return strings.NewReader("a{}"), "text/css", nil
+		case "/app.js":
+			atomic.AddInt32(&scriptOpens, 1)
+			return strings.NewReader("alert(1)"), "", nil
+		}
+		return nil, "", os.ErrNotExist
+	})
+
+	p := New("", opener, NewDefaultCache())
+	p.PushPolicy = MaxBytesPolicy(10)
+
+	doc := `<link rel="stylesheet" href="/style.css"><script src="/app.js"></script><img src="/image.png">`
+	for i := 0; i < 2; i++ {
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+		test.Error(t, err, nil)
+		pw.Write([]byte(doc))
+		test.Error(t, pw.Close(), nil)
+		test.String(t, strings.Join(w.URIs, ","), "/style.css", "pushed resources of request", i)
+	}
+
+	resources, _ := p.cache.Get("/")
+	test.String(t, strings.Join(resources, ","), "/style.css,/app.js,/image.png", "cache keeps all resources")
+	test.That(t, atomic.LoadInt32(&scriptOpens) == 2, "opened once by the parser and once for its size")
+
+	// sizes are only determined for policies that need them
+	atomic.StoreInt32(&scriptOpens, 0)
+	cache := NewDefaultCache()
+	cache.Add("/", "/style.css")
+	cache.Add("/", "/app.js")
+	p = New("", opener, cache)
+	p.PushPolicy = KindPolicy(ScriptKind)
+	w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(doc))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/app.js")
+	test.That(t, atomic.LoadInt32(&scriptOpens) == 0, "size is not determined")
+}
+
+func TestResponseWriterFirstBytes(t *testing.T) {
+	p := New("", nil, NewDefaultCache())
+	p.PushPolicy = FirstBytesPolicy(32)
+
+	for i := 0; i < 2; i++ {
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+		test.Error(t, err, nil)
+		pw.Write([]byte(`<img src="/first.png">`))
+		pw.Write([]byte(strings.Repeat(" ", 64)))
+		pw.Write([]byte(`<img src="/last.png">`))
+		test.Error(t, pw.Close(), nil)
+		test.String(t, strings.Join(w.URIs, ","), "/first.png", "pushed resources of request", i)
+	}
+
+	// offsets of entries cached by another P are unknown
+	p2 := New("", nil, p.cache)
+	p2.PushPolicy = FirstBytesPolicy(32)
+	w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err := p2.ResponseWriter(w, httptest.NewRequest("GET", "/", nil))
+	test.Error(t, err, nil)
+	pw.Write([]byte(`<img src="/first.png">` + strings.Repeat(" ", 64) + `<img src="/last.png">`))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/first.png,/last.png")
+}
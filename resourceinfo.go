@@ -0,0 +1,155 @@
+package push
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceInfoTTL is the duration for which the size, version and integrity hashes of a local resource are cached when the FileOpener does not return an *os.File. Those of files are cached until their modification time or size changes.
+var ResourceInfoTTL = time.Minute
+
+// resourceInfo is the size, version and integrity metadata of a local resource. It is not modified once cached.
+type resourceInfo struct {
+	file      bool      // opened as *os.File and validated by modTime and size
+	modTime   time.Time // modification time of files
+	read      time.Time // time the contents were read, for resources that are not files
+	size      int64
+	version   string
+	integrity map[string]string // algorithm -> integrity metadata
+}
+
+// has returns true if the info holds the integrity metadata for algorithm, or if algorithm is empty.
+func (info *resourceInfo) has(algorithm string) bool {
+	_, ok := info.integrity[algorithm]
+	return algorithm == "" || ok
+}
+
+// resourceInfos caches the resourceInfo of local resources per URI.
+type resourceInfos struct {
+	opener FileOpener
+	infos  map[string]*resourceInfo
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+func newResourceInfos(opener FileOpener) *resourceInfos {
+	return &resourceInfos{opener, map[string]*resourceInfo{}, sync.Mutex{}, time.Now}
+}
+
+// integrity returns the integrity metadata of uri for algorithm, or an empty string if it cannot be opened.
+func (c *resourceInfos) integrity(uri, algorithm string) string {
+	if info := c.get(uri, algorithm); info != nil {
+		return info.integrity[algorithm]
+	}
+	return ""
+}
+
+// size returns the size of uri in bytes, or -1 if it cannot be opened.
+func (c *resourceInfos) size(uri string) int64 {
+	if info := c.get(uri, ""); info != nil {
+		return info.size
+	}
+	return -1
+}
+
+// version returns a validator of the contents of uri, or an empty string if it cannot be opened. Files are validated by modification time and size, other readers by the hash of their contents.
+func (c *resourceInfos) version(uri string) string {
+	if info := c.get(uri, ""); info != nil {
+		return info.version
+	}
+	return ""
+}
+
+// get returns the info of uri including the integrity metadata for algorithm if not empty, or nil if it cannot be opened. Files are opened to check their modification time and size, and only read when a hash is missing. Other resources are read again after ResourceInfoTTL.
+func (c *resourceInfos) get(uri, algorithm string) *resourceInfo {
+	if c.opener == nil {
+		return nil
+	}
+	if i := strings.IndexByte(uri, '?'); i != -1 {
+		uri = uri[:i]
+	}
+
+	c.mutex.Lock()
+	cached := c.infos[uri]
+	c.mutex.Unlock()
+	if cached != nil && !cached.file && c.now().Sub(cached.read) < ResourceInfoTTL && cached.has(algorithm) {
+		return cached
+	}
+
+	r, _, err := c.opener.Open(uri)
+	if err != nil {
+		c.mutex.Lock()
+		delete(c.infos, uri)
+		c.mutex.Unlock()
+		return nil
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	info := &resourceInfo{integrity: map[string]string{}}
+	if f, ok := r.(*os.File); ok {
+		stat, err := f.Stat()
+		if err != nil {
+			return nil
+		}
+		info.file, info.modTime, info.size = true, stat.ModTime(), stat.Size()
+		info.version = `"` + strconv.FormatInt(info.modTime.UnixNano(), 16) + "-" + strconv.FormatInt(info.size, 16) + `"`
+		if cached != nil && cached.file && cached.version == info.version {
+			if cached.has(algorithm) {
+				return cached
+			}
+			info.integrity = copyIntegrity(cached.integrity)
+		}
+	}
+
+	if !info.file || algorithm != "" {
+		writers := []io.Writer{}
+		var versionHash, integrityHash hash.Hash
+		if !info.file {
+			versionHash = md5.New()
+			writers = append(writers, versionHash)
+		}
+		if algorithm != "" {
+			if integrityHash, err = newIntegrityHash(algorithm); err != nil {
+				return nil
+			}
+			writers = append(writers, integrityHash)
+		}
+
+		n, err := io.Copy(io.MultiWriter(writers...), r)
+		if err != nil {
+			return nil
+		}
+		if !info.file {
+			info.read, info.size = c.now(), n
+			info.version = `"` + hex.EncodeToString(versionHash.Sum(nil)) + `"`
+			if cached != nil && !cached.file && cached.version == info.version {
+				info.integrity = copyIntegrity(cached.integrity)
+			}
+		}
+		if integrityHash != nil {
+			info.integrity[algorithm] = integrityMetadata(integrityHash, algorithm)
+		}
+	}
+
+	c.mutex.Lock()
+	c.infos[uri] = info
+	c.mutex.Unlock()
+	return info
+}
+
+func copyIntegrity(integrity map[string]string) map[string]string {
+	dst := make(map[string]string, len(integrity)+1)
+	for algorithm, metadata := range integrity {
+		dst[algorithm] = metadata
+	}
+	return dst
+}
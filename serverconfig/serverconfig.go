@@ -0,0 +1,112 @@
+// Package serverconfig generates web server configuration that preloads or pushes the resources of a push.PushManifest, for sites that are not served by Go.
+package serverconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tdewolff/push"
+)
+
+// NginxVariable is the variable that Nginx sets to the preload Link header of the requested page.
+const NginxVariable = "$push_links"
+
+// Nginx writes a map block for the http context that sets NginxVariable to the preload Link header of the requested page. Unlike location blocks, it does not drop the add_header directives of the server block nor override the locations of the site. Use it in the server block with "http2_push_preload on; add_header Link $push_links;", which also pushes the resources, and repeat the add_header directive in locations that have their own.
+func Nginx(w io.Writer, m push.PushManifest) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# in the server block: http2_push_preload on; add_header Link %s;\n", NginxVariable)
+	fmt.Fprintf(bw, "map $uri %s {\n\tdefault \"\";\n", NginxVariable)
+	for _, page := range pages(m) {
+		links := links(m, page)
+		if len(links) == 0 {
+			continue
+		}
+		for _, location := range locations(page) {
+			fmt.Fprintf(bw, "\t%s %s;\n", quote(location), quote(strings.Join(links, ", ")))
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// Apache writes an If section for each page that adds a preload Link header for each resource. With H2Push enabled (the default of mod_http2) Apache also pushes the resources.
+func Apache(w io.Writer, m push.PushManifest) error {
+	bw := bufio.NewWriter(w)
+	for _, page := range pages(m) {
+		links := links(m, page)
+		if len(links) == 0 {
+			continue
+		}
+		conds := []string{}
+		for _, location := range locations(page) {
+			conds = append(conds, "%{REQUEST_URI} == '"+strings.Replace(location, "'", "\\'", -1)+"'")
+		}
+		fmt.Fprintf(bw, "<If %s>\n", quote(strings.Join(conds, " || ")))
+		for _, link := range links {
+			fmt.Fprintf(bw, "\tHeader add Link %s\n", quote(link))
+		}
+		bw.WriteString("</If>\n\n")
+	}
+	return bw.Flush()
+}
+
+// Caddy writes a named path matcher for each page and header directives that add a preload Link header for each resource, to be included in a site block of a Caddyfile.
+func Caddy(w io.Writer, m push.PushManifest) error {
+	bw := bufio.NewWriter(w)
+	for i, page := range pages(m) {
+		links := links(m, page)
+		if len(links) == 0 {
+			continue
+		}
+		matcher := fmt.Sprintf("@push%d", i)
+		fmt.Fprintf(bw, "%s path", matcher)
+		for _, location := range locations(page) {
+			fmt.Fprintf(bw, " %s", location)
+		}
+		bw.WriteString("\n")
+		for _, link := range links {
+			fmt.Fprintf(bw, "header %s +Link %s\n", matcher, quote(link))
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+////////////////
+
+// pages returns the pages of the manifest in order.
+func pages(m push.PushManifest) []string {
+	pages := make([]string, 0, len(m))
+	for page := range m {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+	return pages
+}
+
+func links(m push.PushManifest, page string) []string {
+	links := []string{}
+	for _, uri := range m.Resources(page) {
+		links = append(links, push.PreloadLink(uri, m[page][uri].Type))
+	}
+	return links
+}
+
+// locations returns the request paths of a page, which includes the directory for index.html.
+func locations(page string) []string {
+	if !strings.HasPrefix(page, "/") {
+		page = "/" + page
+	}
+	if strings.HasSuffix(page, "/index.html") {
+		return []string{strings.TrimSuffix(page, "index.html"), page}
+	}
+	return []string{page}
+}
+
+// quote returns s as a double-quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
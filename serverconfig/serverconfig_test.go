@@ -0,0 +1,50 @@
+package serverconfig
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tdewolff/push"
+	"github.com/tdewolff/test"
+)
+
+var manifest = push.PushManifest{
+	"/index.html": {
+		"/style.css":  {"style", 1},
+		"/font.woff2": {"font", 2},
+	},
+	"/about.html": {},
+}
+
+func TestNginx(t *testing.T) {
+	buf := &bytes.Buffer{}
+	test.Error(t, Nginx(buf, manifest), nil)
+	test.String(t, buf.String(), `# in the server block: http2_push_preload on; add_header Link $push_links;
+map $uri $push_links {
+	default "";
+	"/" "</font.woff2>; rel=preload; as=font; crossorigin, </style.css>; rel=preload; as=style";
+	"/index.html" "</font.woff2>; rel=preload; as=font; crossorigin, </style.css>; rel=preload; as=style";
+}
+`)
+}
+
+func TestApache(t *testing.T) {
+	buf := &bytes.Buffer{}
+	test.Error(t, Apache(buf, manifest), nil)
+	test.String(t, buf.String(), `<If "%{REQUEST_URI} == '/' || %{REQUEST_URI} == '/index.html'">
+	Header add Link "</font.woff2>; rel=preload; as=font; crossorigin"
+	Header add Link "</style.css>; rel=preload; as=style"
+</If>
+
+`)
+}
+
+func TestCaddy(t *testing.T) {
+	buf := &bytes.Buffer{}
+	test.Error(t, Caddy(buf, manifest), nil)
+	test.String(t, buf.String(), `@push1 path / /index.html
+header @push1 +Link "</font.woff2>; rel=preload; as=font; crossorigin"
+header @push1 +Link "</style.css>; rel=preload; as=style"
+
+`)
+}
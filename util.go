@@ -2,11 +2,15 @@ package push
 
 import (
 	"errors"
+	"hash"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -19,16 +23,45 @@ var ExtToMimetype = map[string]string{
 	".html": "text/html",
 	".css":  "text/css",
 	".svg":  "image/svg+xml",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
 }
 
 type P struct {
 	baseURL string
 	opener  FileOpener
 	cache   Cache
+
+	// CacheKey returns the key of the cache entry for a request. Defaults to RequestURIKey.
+	CacheKey CacheKeyFunc
+
+	// Manifest, if not nil, is used to push resources instead of parsing responses, see PushManifest.
+	Manifest PushManifest
+
+	// PushPolicy, if not nil, decides which of the resources found or cached for a request are pushed. The cache stores all resources regardless of the policy.
+	PushPolicy PushPolicy
+
+	// DigestCookie, if not empty, is the name of a cookie that holds a digest of the resources pushed to the client, see Digest. Resources in the digest are not pushed again unless they have changed.
+	DigestCookie string
+
+	// PushWindow is the number of found resources that are buffered to push them in order of ResourcePriority. Defaults to DefaultPushWindow, zero pushes resources in order of discovery. Cached resources are always stored in order of priority.
+	PushWindow int
+
+	// Integrity, if not empty, is the hash algorithm (sha256, sha384 or sha512) of the integrity attributes that are added to local scripts and stylesheets of HTML responses, see IntegrityWriter. Requires a FileOpener.
+	Integrity string
+
+	flights      map[string]*flight
+	flightsMutex sync.Mutex
+	vary         map[string][]string // URL path -> request headers in the Vary header of the last response
+	varyMutex    sync.RWMutex
+	varying      int32 // set when VaryKey is used
+	infos        *resourceInfos
+	offsets      map[string]map[string]int64 // cache key -> URI -> offset of the cached resources, for PushPolicy
+	offsetsMutex sync.RWMutex
 }
 
 func New(baseURL string, opener FileOpener, cache Cache) *P {
-	return &P{baseURL, opener, cache}
+	return &P{baseURL, opener, cache, RequestURIKey, nil, nil, "", DefaultPushWindow, "", make(map[string]*flight), sync.Mutex{}, make(map[string][]string), sync.RWMutex{}, 0, newResourceInfos(opener), make(map[string]map[string]int64), sync.RWMutex{}}
 }
 
 type pushingWriter struct {
@@ -74,7 +107,56 @@ type nopResponseWriter struct {
 	http.ResponseWriter
 }
 
-func (_ *nopResponseWriter) Close() error {
+func (w *nopResponseWriter) Close() error {
+	if closer, ok := w.ResponseWriter.(rewriteCloser); ok {
+		return closer.closeRewrite()
+	}
+	return nil
+}
+
+// rewriteCloser is implemented by the ResponseWriter wrappers that rewrite the response, which must be closed to write the remainder of the response.
+type rewriteCloser interface {
+	closeRewrite() error
+}
+
+// htmlResponseWriter rewrites HTML responses through the writer returned by rewrite, other responses are written unchanged.
+type htmlResponseWriter struct {
+	http.ResponseWriter
+
+	mimetype string
+	rewrite  func(io.Writer) io.WriteCloser
+	writer   io.WriteCloser
+	started  bool
+}
+
+func (w *htmlResponseWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		// first write
+		w.started = true
+		if mediatype := w.ResponseWriter.Header().Get("Content-Type"); mediatype != "" {
+			if mimetype, _, err := mime.ParseMediaType(mediatype); err == nil {
+				w.mimetype = mimetype
+			}
+		}
+		if w.mimetype == "text/html" {
+			w.ResponseWriter.Header().Del("Content-Length")
+			w.writer = w.rewrite(w.ResponseWriter)
+		}
+	}
+	if w.writer == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.writer.Write(b)
+}
+
+func (w *htmlResponseWriter) Close() error {
+	return w.closeRewrite()
+}
+
+func (w *htmlResponseWriter) closeRewrite() error {
+	if w.writer != nil {
+		return w.writer.Close()
+	}
 	return nil
 }
 
@@ -85,29 +167,115 @@ type pushingResponseWriter struct {
 	parser   *Parser
 	mimetype string
 	uri      string
+
+	started   bool
+	wroteBody bool
+	hit       *cacheHit        // cached resources that are pushed when the response validator matches
+	validate  bool             // whether to compute the validator of the response
+	hash      hash.Hash64      // hash of the body, used as validator when the response has no ETag or Last-Modified header
+	validator string           // validator of the response
+	queue     *PriorityHandler // flushed after parsing, nil when pushing in order of discovery
+	aborted   bool             // the handler did not finish, the response is not cached
+	onClose   func(parsed bool, validator string)
+}
+
+type cacheHit struct {
+	resources []string
+	validator string
+	pusher    URIHandler
+}
+
+func (w *pushingResponseWriter) WriteHeader(code int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// start is called when the header is written, it computes the validator of the response and pushes the cached resources when they are valid.
+func (w *pushingResponseWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	if w.validate {
+		if w.validator = ResponseValidator(w.ResponseWriter.Header()); w.validator == "" {
+			w.hash = fnv.New64a()
+		}
+	}
+
+	if w.hit != nil && (w.validator != "" && w.validator == w.hit.validator || w.validator == "" && strings.HasPrefix(w.hit.validator, bodyHashPrefix)) {
+		for _, uri := range w.hit.resources {
+			if err := w.hit.pusher.URI(uri); err != nil {
+				break
+			}
+		}
+	} else {
+		w.hit = nil
+	}
 }
 
 func (w *pushingResponseWriter) Write(b []byte) (int, error) {
-	if w.writer == nil {
-		// first write
+	w.start()
+	if w.hit == nil && w.writer == nil {
+		// first write of a response that is parsed
 		if mediatype := w.ResponseWriter.Header().Get("Content-Type"); mediatype != "" {
-			if mimetype, _, err := mime.ParseMediaType(mediatype); err != nil {
+			if mimetype, _, err := mime.ParseMediaType(mediatype); err == nil {
 				w.mimetype = mimetype
 			}
 		}
 		w.writer = Writer(w.ResponseWriter, w.parser, w.mimetype, w.uri)
 	}
+	if w.hash != nil {
+		w.hash.Write(b)
+	}
+	w.wroteBody = w.wroteBody || len(b) > 0
+	if w.writer == nil {
+		return w.ResponseWriter.Write(b)
+	}
 	return w.writer.Write(b)
 }
 
 func (w *pushingResponseWriter) Close() error {
+	var err error
 	if w.writer != nil {
-		return w.writer.Close()
+		err = w.writer.Close()
 	}
-	return nil
+	if w.queue != nil {
+		if errFlush := w.queue.Flush(); err == nil {
+			err = errFlush
+		}
+	}
+	if w.onClose != nil {
+		validator := w.validator
+		if !w.wroteBody {
+			validator = "" // unknown for responses without body, such as 304 Not Modified or HEAD
+		} else if w.hash != nil {
+			validator = bodyHashPrefix + strconv.FormatUint(w.hash.Sum64(), 16)
+		}
+		w.onClose(w.writer != nil && err == nil && !w.aborted && w.wroteBody, validator)
+	}
+	if closer, ok := w.ResponseWriter.(rewriteCloser); ok {
+		if errClose := closer.closeRewrite(); err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// bodyHashPrefix is the prefix of validators that are a hash of the response body.
+const bodyHashPrefix = "hash:"
+
+// ResponseValidator returns the ETag or else the Last-Modified header of a response, or an empty string if neither is set.
+func ResponseValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return header.Get("Last-Modified")
 }
 
 // ResponseWriter wraps a ResponseWriter interface. It parses anything written to the returned ResponseWriter and pushes local resources to the client. If FileOpener is not nil, it will read and parse the referenced URIs recursively. If Cache is not nil, it will cache the URIs found and use it on subsequent requests.
+// The cache entry is set only after the response has been parsed successfully. Concurrent requests for an URI that is not cached wait for the first request to be parsed and push its resources, so that each URI is parsed once.
+// If Cache is a ValidatingCache, entries store the ETag or Last-Modified header of the response, or otherwise a hash of the body. A cached entry is only pushed when the response has the same ETag or Last-Modified header, otherwise the response is parsed again. When validating by body hash the cached resources are pushed, and the entry is deleted at Close if the hash differs. Entries are kept for responses without body.
+// Found resources are pushed in order of ResourcePriority within a window of PushWindow resources. If PushPolicy is not nil, only the resources it allows are pushed. If DigestCookie is not empty, resources that were pushed before are skipped, the cookie is updated with the resources pushed before the response header is written, which includes cached resources but not resources found while parsing. Resources in the Cache-Digest request header are not pushed. If Manifest is not nil, the resources of the request path in the manifest are pushed and the response is not parsed. If Integrity is not empty, integrity attributes are added to HTML responses, also when the ResponseWriter is not a Pusher.
 // ResponseWriter can only return ErrNoPusher, ErrRecursivePush or ErrNoParser errors.
 // Parsing errors are returned by Close on the writer. The writer must be closed explicitly.
 func (p *P) ResponseWriter(w http.ResponseWriter, r *http.Request) (ResponseWriterCloser, error) {
@@ -115,46 +283,195 @@ func (p *P) ResponseWriter(w http.ResponseWriter, r *http.Request) (ResponseWrit
 		return &nopResponseWriter{w}, ErrRecursivePush
 	}
 
-	pusher, err := NewPushHandlerFromResponseWriter(w)
+	pushHandler, err := NewPushHandlerFromResponseWriter(w)
+	var digest *cookieDigest
+	if err == nil && p.DigestCookie != "" {
+		digest = p.cookieDigest(r)
+		w = &digestResponseWriter{w, digest, false}
+	}
+	if p.Integrity != "" && p.opener != nil {
+		w = p.integrityResponseWriter(w, r)
+	}
 	if err != nil {
 		return &nopResponseWriter{w}, err
 	}
 
+	var pusher URIHandler = pushHandler
+	if digest != nil {
+		pusher = &digestRecorder{digest, pusher}
+	}
+	if p.PushPolicy != nil {
+		var offsets map[string]int64
+		if p.cache != nil {
+			offsets = p.cachedOffsets(p.CacheKey(r))
+		}
+		pusher = &policyHandler{p.PushPolicy, r, p.infos, offsets, pusher, []PushResource{}, sync.Mutex{}}
+	}
+	if digest != nil {
+		pusher = &digestFilter{digest.contains, pusher}
+	}
+	if contains := p.cacheDigestContains(r); contains != nil {
+		pusher = &digestFilter{contains, pusher}
+	}
+	found := pusher // handles the resources found while parsing
+	var queue *PriorityHandler
+	if p.PushWindow > 0 {
+		queue = NewPriorityHandler(pusher, p.PushWindow)
+		found = queue
+	}
+
+	if p.Manifest != nil {
+		for _, uri := range p.Manifest.Resources(r.URL.Path) {
+			if err = pusher.URI(uri); err != nil {
+				return &nopResponseWriter{w}, err
+			}
+		}
+		return &nopResponseWriter{w}, nil
+	}
+
 	var uriHandler URIHandler
+	var hit *cacheHit
+	var validate bool
+	var onClose func(bool, string)
 	if p.cache != nil {
-		if resources, ok := p.cache.Get(r.RequestURI); ok {
+		key := p.CacheKey(r)
+		validatingCache, validating := p.cache.(ValidatingCache)
+
+		var resources []string
+		var validator string
+		var ok bool
+		if validating {
+			resources, validator, ok = validatingCache.GetValidated(key)
+		} else {
+			resources, ok = p.cache.Get(key)
+		}
+
+		var f *flight
+		isLeader := false
+		if !ok {
+			if f, ok = p.startFlight(key); ok {
+				resources, ok = p.waitFlight(r, key, f)
+				if !ok {
+					return &nopResponseWriter{w}, nil
+				}
+			} else {
+				isLeader = true
+			}
+		}
+		if ok && validator == "" {
 			for _, uri := range resources {
 				if err = pusher.URI(uri); err != nil {
 					return &nopResponseWriter{w}, err
 				}
 			}
 			return &nopResponseWriter{w}, nil
+		} else if ok {
+			hit = &cacheHit{resources, validator, pusher}
 		}
 
-		p.cache.Del(r.RequestURI)
-		uriHandler = URIHandlerFunc(func(uri string) error {
-			p.cache.Add(r.RequestURI, uri)
-			return pusher.URI(uri)
-		})
+		listing := &listingHandler{found, []Resource{}, sync.Mutex{}}
+		uriHandler = listing
+		onClose = func(parsed bool, curValidator string) {
+			setKey := key
+			if p.setVary(r.URL.Path, w.Header().Get("Vary")) {
+				// store the response under the key of the new Vary header, the entry under the old key is stale
+				if setKey = p.CacheKey(r); setKey != key {
+					p.cache.Del(key)
+					p.setOffsets(key, nil)
+				}
+			}
+
+			uris := listing.URIs()
+			if parsed {
+				if validating {
+					validatingCache.SetValidated(setKey, uris, curValidator)
+				} else {
+					p.cache.Set(setKey, uris)
+				}
+				p.setOffsets(setKey, listing.Resources())
+			} else if hit != nil && curValidator != "" && curValidator != hit.validator {
+				p.cache.Del(setKey)
+				p.setOffsets(setKey, nil)
+			}
+			if isLeader {
+				p.endFlight(key, f, uris, parsed)
+			}
+		}
+		validate = validating
 	} else {
-		uriHandler = pusher
+		uriHandler = found
 	}
 
 	parser, err := NewParser(p.baseURL, p.opener, uriHandler)
 	if err != nil {
+		if onClose != nil {
+			onClose(false, "")
+		}
 		return &nopResponseWriter{w}, err
 	}
 
 	mimetype, _ := ExtToMimetype[path.Ext(r.RequestURI)]
-	return &pushingResponseWriter{w, nil, parser, mimetype, r.RequestURI}, nil
+	return &pushingResponseWriter{w, nil, parser, mimetype, r.RequestURI, false, false, hit, validate, nil, "", queue, false, onClose}, nil
+}
+
+// listingHandler lists the resources passed to the next handler, which may be nil.
+type listingHandler struct {
+	next URIHandler
+
+	resources []Resource
+	mutex     sync.Mutex
 }
 
-// Middleware wraps an http.Handler and pushes local resources to the client. If FileOpener is not nil, it will read and parse the referenced URIs recursively. If Cache is not nil, it will cache the URIs found and use it on subsequent requests.
+func (h *listingHandler) URI(uri string) error {
+	return h.Resource(Resource{URI: uri, Offset: -1})
+}
+
+func (h *listingHandler) Resource(res Resource) error {
+	h.mutex.Lock()
+	h.resources = append(h.resources, res)
+	h.mutex.Unlock()
+	if h.next == nil {
+		return nil
+	} else if next, ok := h.next.(ResourceHandler); ok {
+		return next.Resource(res)
+	}
+	return h.next.URI(res.URI)
+}
+
+// Resources returns the listed resources in order of discovery.
+func (h *listingHandler) Resources() []Resource {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]Resource{}, h.resources...)
+}
+
+// URIs returns the URIs of the listed resources in order of priority.
+func (h *listingHandler) URIs() []string {
+	h.mutex.Lock()
+	resources := append([]Resource{}, h.resources...)
+	h.mutex.Unlock()
+	SortResources(resources)
+
+	uris := make([]string, 0, len(resources))
+	for _, res := range resources {
+		uris = append(uris, res.URI)
+	}
+	return uris
+}
+
+// Middleware wraps an http.Handler and pushes local resources to the client. If FileOpener is not nil, it will read and parse the referenced URIs recursively. If Cache is not nil, it will cache the URIs found and use it on subsequent requests. The response is not cached when the handler panics.
 func (p *P) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		pw, _ := p.ResponseWriter(w, r)
+		completed := false
+		defer func() {
+			if pushWriter, ok := pw.(*pushingResponseWriter); ok && !completed {
+				pushWriter.aborted = true // handler panicked
+			}
+			pw.Close()
+		}()
 		next.ServeHTTP(pw, r)
-		pw.Close()
+		completed = true
 	})
 }
 
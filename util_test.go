@@ -2,11 +2,15 @@ package push
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/tdewolff/test"
 )
@@ -44,3 +48,193 @@ func TestList(t *testing.T) {
 	sort.Strings(uris)
 	test.String(t, strings.Join(uris, ","), "/frame.html,/image.svg,/style.css")
 }
+
+type pushResponseWriter struct {
+	*httptest.ResponseRecorder
+	*ListHandler
+}
+
+func (w *pushResponseWriter) Push(uri string, _ *http.PushOptions) error {
+	return w.URI(uri)
+}
+
+type countingCache struct {
+	*DefaultCache
+	sets int
+}
+
+func (c *countingCache) Set(uri string, resources []string) {
+	c.sets++
+	c.DefaultCache.Set(uri, resources)
+}
+
+func (c *countingCache) SetValidated(uri string, resources []string, validator string) {
+	c.sets++
+	c.DefaultCache.SetValidated(uri, resources, validator)
+}
+
+func TestResponseWriterCache(t *testing.T) {
+	cache := &countingCache{NewDefaultCache(), 0}
+	p := New("example.com/", nil, cache)
+
+	w1 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw1, err := p.ResponseWriter(w1, httptest.NewRequest("GET", "/index.html", nil))
+	test.Error(t, err, nil)
+
+	done := make(chan *pushResponseWriter)
+	go func() {
+		w2 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw2, err := p.ResponseWriter(w2, httptest.NewRequest("GET", "/index.html", nil))
+		test.Error(t, err, nil)
+		pw2.Write([]byte(`<link rel="stylesheet" href="/style.css"><img src="/image.png">`))
+		pw2.Close()
+		done <- w2
+	}()
+
+	_, err = pw1.Write([]byte(`<link rel="stylesheet" href="/style.css">`))
+	test.Error(t, err, nil)
+	_, ok := cache.Get("/index.html")
+	test.That(t, !ok, "no partial entry while parsing")
+
+	_, err = pw1.Write([]byte(`<img src="/image.png">`))
+	test.Error(t, err, nil)
+	test.Error(t, pw1.Close(), nil)
+
+	w2 := <-done
+	test.String(t, strings.Join(w1.URIs, ","), "/style.css,/image.png")
+	test.String(t, strings.Join(w2.URIs, ","), "/style.css,/image.png")
+	test.That(t, cache.sets == 1, "parsed once")
+
+	resources, ok := cache.Get("/index.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/style.css,/image.png")
+}
+
+func TestResponseWriterValidator(t *testing.T) {
+	cache := &countingCache{NewDefaultCache(), 0}
+	p := New("example.com/", nil, cache)
+
+	serve := func(etag, body string) string {
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/index.html", nil))
+		test.Error(t, err, nil)
+		if etag != "" {
+			pw.Header().Set("ETag", etag)
+		}
+		_, err = pw.Write([]byte(body))
+		test.Error(t, err, nil)
+		test.Error(t, pw.Close(), nil)
+		test.String(t, w.Body.String(), body)
+		return strings.Join(w.URIs, ",")
+	}
+
+	test.String(t, serve(`"a"`, `<img src="/a.png">`), "/a.png")
+	test.String(t, serve(`"a"`, `<img src="/a.png">`), "/a.png")
+	test.That(t, cache.sets == 1, "cached by ETag")
+	test.String(t, serve(`"b"`, `<img src="/b.png">`), "/b.png")
+	test.That(t, cache.sets == 2, "parsed again on different ETag")
+
+	// body hash
+	test.String(t, serve("", `<img src="/c.png">`), "/c.png")
+	test.That(t, cache.sets == 3)
+	test.String(t, serve("", `<img src="/c.png">`), "/c.png")
+	test.That(t, cache.sets == 3, "cached by body hash")
+	serve("", `<img src="/d.png">`)
+	_, ok := cache.Get("/index.html")
+	test.That(t, !ok, "deleted on different body hash")
+	test.String(t, serve("", `<img src="/d.png">`), "/d.png")
+}
+
+func TestResponseWriterFlightTimeout(t *testing.T) {
+	timeout := FlightTimeout
+	FlightTimeout = 10 * time.Millisecond
+	defer func() { FlightTimeout = timeout }()
+
+	p := New("example.com/", nil, NewDefaultCache())
+	w1 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	_, err := p.ResponseWriter(w1, httptest.NewRequest("GET", "/index.html", nil)) // never closed
+	test.Error(t, err, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w2 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw2, err := p.ResponseWriter(w2, httptest.NewRequest("GET", "/index.html", nil).WithContext(ctx))
+	test.Error(t, err, nil)
+	_, waiting := pw2.(*nopResponseWriter)
+	test.That(t, waiting, "canceled request does not wait")
+
+	w3 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw3, err := p.ResponseWriter(w3, httptest.NewRequest("GET", "/index.html", nil))
+	test.Error(t, err, nil)
+	_, waiting = pw3.(*nopResponseWriter)
+	test.That(t, waiting, "request does not wait after the timeout")
+
+	w4 := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw4, err := p.ResponseWriter(w4, httptest.NewRequest("GET", "/index.html", nil))
+	test.Error(t, err, nil)
+	pw4.Write([]byte(`<img src="/image.png">`))
+	test.Error(t, pw4.Close(), nil)
+	test.String(t, strings.Join(w4.URIs, ","), "/image.png", "new flight after the abandoned one")
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	cache := NewDefaultCache()
+	p := New("example.com/", nil, cache)
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<img src="/image.png">`))
+		panic("handler")
+	}))
+
+	func() {
+		defer func() {
+			test.That(t, recover() != nil, "panic is propagated")
+		}()
+		handler.ServeHTTP(&pushResponseWriter{httptest.NewRecorder(), NewListHandler()}, httptest.NewRequest("GET", "/index.html", nil))
+	}()
+	_, ok := cache.Get("/index.html")
+	test.That(t, !ok, "not cached after a panic")
+
+	f, ok := p.startFlight("/index.html")
+	test.That(t, !ok, "flight has ended")
+	p.endFlight("/index.html", f, nil, false)
+}
+
+func TestResponseWriterNoBody(t *testing.T) {
+	p := New("example.com/", nil, NewDefaultCache())
+
+	serve := func(etag string, code int, body string) string {
+		w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+		pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/index.html", nil))
+		test.Error(t, err, nil)
+		if etag != "" {
+			pw.Header().Set("ETag", etag)
+		}
+		pw.WriteHeader(code)
+		pw.Write([]byte(body))
+		test.Error(t, pw.Close(), nil)
+		return strings.Join(w.URIs, ",")
+	}
+
+	test.String(t, serve(`"a"`, http.StatusOK, `<img src="/a.png">`), "/a.png")
+	test.String(t, serve(`"a"`, http.StatusNotModified, ""), "/a.png", "cached resources are pushed on the header")
+	test.String(t, serve(`"b"`, http.StatusOK, ""), "")
+	_, ok := p.cache.Get("/index.html")
+	test.That(t, ok, "kept when there is no body")
+
+	test.String(t, serve("", http.StatusOK, `<img src="/c.png">`), "/c.png")
+	test.String(t, serve("", http.StatusNotModified, ""), "/c.png")
+	resources, _ := p.cache.Get("/index.html")
+	test.String(t, strings.Join(resources, ","), "/c.png", "kept by body hash when there is no body")
+}
+
+func TestResponseWriterContentType(t *testing.T) {
+	p := New("", nil, nil)
+
+	w := &pushResponseWriter{httptest.NewRecorder(), NewListHandler()}
+	pw, err := p.ResponseWriter(w, httptest.NewRequest("GET", "/style", nil))
+	test.Error(t, err, nil)
+	pw.Header().Set("Content-Type", "text/css; charset=utf-8")
+	pw.Write([]byte(`a { background: url(/bg.png); }`))
+	test.Error(t, pw.Close(), nil)
+	test.String(t, strings.Join(w.URIs, ","), "/bg.png", "parsed by the mimetype of the Content-Type header")
+}
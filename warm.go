@@ -0,0 +1,200 @@
+package push
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tdewolff/parse"
+	"github.com/tdewolff/parse/html"
+)
+
+// ErrNoCache is returned when warming a P without Cache.
+var ErrNoCache = errors.New("no cache")
+
+// Warm populates the cache by parsing the entry URIs, so that their resources are pushed from the first request on. Each URI is requested from handler, or read from the FileOpener if handler is nil, in which case directory URIs are read from their index.html. Same-origin <a href> links in HTML pages are followed up to depth links away from the entry URIs, each URI is warmed at most once.
+// Requests to handler have no Pusher, so that handlers wrapped by Middleware pass through. Responses that are not 200 OK or have no parser are not cached. Warm continues after an error and returns the first error.
+func (p *P) Warm(uris []string, handler http.Handler, depth int) error {
+	if p.cache == nil {
+		return ErrNoCache
+	}
+
+	var firstErr error
+	visited := map[string]bool{}
+	for level := 0; level <= depth && len(uris) > 0; level++ {
+		next := []string{}
+		for _, uri := range uris {
+			if visited[uri] {
+				continue
+			}
+			visited[uri] = true
+
+			links, err := p.warm(uri, handler, level < depth)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			next = append(next, links...)
+		}
+		uris = next
+	}
+	return firstErr
+}
+
+// warm fetches, parses and caches uri and returns the links found when follow is true.
+func (p *P) warm(uri string, handler http.Handler, follow bool) ([]string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = uri
+
+	var body []byte
+	var mimetype string
+	var validator string
+	if handler != nil {
+		w := &warmResponseWriter{http.Header{}, 0, bytes.Buffer{}}
+		handler.ServeHTTP(w, req)
+		if w.status != 0 && w.status != http.StatusOK {
+			return nil, nil
+		}
+		body = w.body.Bytes()
+		mimetype = ExtToMimetype[path.Ext(req.URL.Path)]
+		if mediatype := w.header.Get("Content-Type"); mediatype != "" {
+			if mimetype, _, err = mime.ParseMediaType(mediatype); err != nil {
+				return nil, err
+			}
+		}
+		validator = ResponseValidator(w.header)
+	} else if p.opener != nil {
+		var r io.Reader
+		if r, mimetype, err = p.opener.Open(pageFile(uri)); err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, ErrNoParser
+	}
+
+	h := &listingHandler{nil, []Resource{}, sync.Mutex{}}
+	parser, err := NewParser(p.baseURL, p.opener, h)
+	if err != nil {
+		return nil, err
+	}
+	if err = parser.Parse(bytes.NewReader(body), mimetype, uri); err == ErrNoParser {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	key := p.CacheKey(req)
+	uris := h.URIs()
+	if cache, ok := p.cache.(ValidatingCache); ok {
+		if validator == "" {
+			hash := fnv.New64a()
+			hash.Write(body)
+			validator = bodyHashPrefix + strconv.FormatUint(hash.Sum64(), 16)
+		}
+		cache.SetValidated(key, uris, validator)
+	} else {
+		p.cache.Set(key, uris)
+	}
+	p.setOffsets(key, h.Resources())
+
+	if !follow || mimetype != "text/html" {
+		return nil, nil
+	}
+	return parser.parseLinks(bytes.NewReader(body), uri)
+}
+
+type warmResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *warmResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *warmResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+////////////////
+
+// parseLinks returns the request URIs of the same-origin <a href> links in an HTML document served by uri.
+func (p *Parser) parseLinks(r io.Reader, uri string) ([]string, error) {
+	reqURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	links := []string{}
+	lexer := html.NewLexer(r)
+	for {
+		tt, data := lexer.Next()
+		switch tt {
+		case html.ErrorToken:
+			if lexer.Err() == io.EOF {
+				return links, nil
+			}
+			return links, lexer.Err()
+		case html.StartTagToken:
+			tag := html.ToHash(lexer.Text())
+			for {
+				attrTokenType, _ := lexer.Next()
+				if attrTokenType != html.AttributeToken {
+					break
+				}
+
+				if tag == html.A && html.ToHash(lexer.Text()) == html.Href {
+					attrVal := lexer.AttrVal()
+					if len(attrVal) > 1 && (attrVal[0] == '"' || attrVal[0] == '\'') {
+						attrVal = parse.TrimWhitespace(attrVal[1 : len(attrVal)-1])
+					}
+					if link := p.linkURI(string(attrVal), reqURL); link != "" {
+						links = append(links, link)
+					}
+				}
+			}
+		}
+		lexer.Free(len(data))
+	}
+}
+
+// linkURI returns the request URI of a link when it is local, or an empty string otherwise.
+func (p *Parser) linkURI(rawLinkURL string, reqURL *url.URL) string {
+	linkURL, err := url.Parse(rawLinkURL)
+	if err != nil || linkURL.Scheme != "" && linkURL.Scheme != "http" && linkURL.Scheme != "https" {
+		return ""
+	} else if linkURL.Host != "" && p.baseURL.Host != "" && linkURL.Host != p.baseURL.Host {
+		return ""
+	}
+
+	resolvedURL := reqURL.ResolveReference(linkURL)
+	if !strings.HasPrefix(resolvedURL.Path, p.baseURL.Path) {
+		return ""
+	}
+	resolvedURL.Scheme, resolvedURL.Host, resolvedURL.Fragment = "", "", ""
+	return resolvedURL.RequestURI()
+}
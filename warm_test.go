@@ -0,0 +1,69 @@
+package push
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/test"
+)
+
+func TestWarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		test.Error(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), nil)
+	}
+	write("index.html", `<link rel="stylesheet" href="/style.css"><a href="/about.html#team">About</a><a href="http://other.com/">Other</a><a href="mailto:a@example.com">Mail</a>`)
+	write("about.html", `<img src="/team.png"><a href="/contact.html?lang=en">Contact</a>`)
+	write("contact.html", `<img src="/map.png">`)
+	write("style.css", `a { background: url(/bg.png); }`)
+
+	cache := NewDefaultCache()
+	p := New("example.com", NewDefaultFileOpener(dir), cache)
+	test.Error(t, p.Warm([]string{"/"}, nil, 1), nil)
+
+	resources, ok := cache.Get("/")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/style.css,/bg.png")
+	resources, ok = cache.Get("/about.html")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/team.png")
+	_, ok = cache.Get("/contact.html?lang=en")
+	test.That(t, !ok, "beyond depth")
+
+	test.Error(t, p.Warm([]string{"/"}, nil, 2), nil)
+	resources, ok = cache.Get("/contact.html?lang=en")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/map.png")
+}
+
+func TestWarmHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`<img src="/img.png"><a href="/missing.html">Missing</a>`))
+	})
+
+	cache := NewDefaultCache()
+	p := New("", nil, cache)
+	test.Error(t, p.Warm([]string{"/"}, handler, 1), nil)
+
+	resources, validator, ok := cache.GetValidated("/")
+	test.That(t, ok)
+	test.String(t, strings.Join(resources, ","), "/img.png")
+	test.String(t, validator, `"v1"`)
+	_, ok = cache.Get("/missing.html")
+	test.That(t, !ok, "not found")
+
+	test.Error(t, New("", nil, nil).Warm([]string{"/"}, handler, 0), ErrNoCache)
+}
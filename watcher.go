@@ -0,0 +1,180 @@
+package push
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type fileState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+// Watcher is a Cache that invalidates cache entries when a file they depend on is changed, added or removed. The dependencies of an entry are the requested page and all resources found by the (recursive) parse, which are polled in the base path of a DefaultFileOpener.
+// For cache keys made by CacheKeys, the request URI must be the first key.
+type Watcher struct {
+	Cache
+	basePath string
+
+	deps      map[string][]string  // cache entry URI -> file URIs
+	files     map[string]fileState // file URI -> state at the last poll
+	refs      map[string]int       // file URI -> number of dependencies on the file
+	mutex     sync.Mutex
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatcher returns a new Watcher that wraps cache and polls the files of opener every interval. Polling is disabled when interval is zero, in which case Poll must be called explicitly.
+// The Watcher is not told about entries that cache evicts by itself, set LRUCache.OnEvict to Forget to stop tracking their files.
+func NewWatcher(cache Cache, opener *DefaultFileOpener, interval time.Duration) *Watcher {
+	w := &Watcher{cache, opener.basePath, make(map[string][]string), make(map[string]fileState), make(map[string]int), sync.Mutex{}, make(chan struct{}), sync.Once{}}
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					w.Poll()
+				case <-w.stop:
+					return
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// Close stops polling, it may be called more than once.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+	})
+	return nil
+}
+
+func (w *Watcher) Add(uri string, resource string) {
+	w.mutex.Lock()
+	if _, ok := w.deps[uri]; !ok {
+		w.deps[uri] = []string{pageFile(keyURI(uri))}
+		w.track(pageFile(keyURI(uri)))
+	}
+	w.deps[uri] = append(w.deps[uri], resource)
+	w.track(resource)
+	w.mutex.Unlock()
+
+	w.Cache.Add(uri, resource)
+}
+
+func (w *Watcher) Set(uri string, resources []string) {
+	w.setDeps(uri, resources)
+	w.Cache.Set(uri, resources)
+}
+
+func (w *Watcher) GetValidated(uri string) ([]string, string, bool) {
+	if cache, ok := w.Cache.(ValidatingCache); ok {
+		return cache.GetValidated(uri)
+	}
+	resources, ok := w.Cache.Get(uri)
+	return resources, "", ok
+}
+
+func (w *Watcher) SetValidated(uri string, resources []string, validator string) {
+	w.setDeps(uri, resources)
+	if cache, ok := w.Cache.(ValidatingCache); ok {
+		cache.SetValidated(uri, resources, validator)
+	} else {
+		w.Cache.Set(uri, resources)
+	}
+}
+
+func (w *Watcher) setDeps(uri string, resources []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	deps := append([]string{pageFile(keyURI(uri))}, resources...)
+	for _, dep := range deps {
+		w.track(dep)
+	}
+	w.untrackDeps(uri)
+	w.deps[uri] = deps
+}
+
+func (w *Watcher) Del(uri string) {
+	w.Forget(uri)
+	w.Cache.Del(uri)
+}
+
+// Forget stops tracking the files of a cache entry that was removed from the wrapped cache. It does not call the wrapped cache and may be used as LRUCache.OnEvict.
+func (w *Watcher) Forget(uri string) {
+	w.mutex.Lock()
+	w.untrackDeps(uri)
+	w.mutex.Unlock()
+}
+
+// Poll checks the files of all cache entries and deletes the entries of which a file has changed, was added or was removed. It returns the URIs of the deleted entries.
+func (w *Watcher) Poll() []string {
+	w.mutex.Lock()
+	files := make(map[string]fileState, len(w.files))
+	for file, state := range w.files {
+		files[file] = state
+	}
+	w.mutex.Unlock()
+
+	changed := map[string]bool{}
+	for file, state := range files {
+		if cur := w.stat(file); cur != state {
+			changed[file] = true
+		}
+	}
+
+	// changed files are no longer tracked once all entries depending on them are deleted, the next Set records their current state
+	w.mutex.Lock()
+	deleted := []string{}
+	for uri, deps := range w.deps {
+		for _, dep := range deps {
+			if changed[dep] {
+				deleted = append(deleted, uri)
+				break
+			}
+		}
+	}
+	for _, uri := range deleted {
+		w.untrackDeps(uri)
+	}
+	w.mutex.Unlock()
+
+	for _, uri := range deleted {
+		w.Cache.Del(uri)
+	}
+	return deleted
+}
+
+// track records the state of a file if it is not yet being tracked and adds a dependency on it, the mutex must be held.
+func (w *Watcher) track(file string) {
+	if w.refs[file]++; w.refs[file] == 1 {
+		w.files[file] = w.stat(file)
+	}
+}
+
+// untrackDeps removes the dependencies of a cache entry and stops tracking files that are no longer depended upon, the mutex must be held.
+func (w *Watcher) untrackDeps(uri string) {
+	for _, file := range w.deps[uri] {
+		if w.refs[file]--; w.refs[file] <= 0 {
+			delete(w.refs, file)
+			delete(w.files, file)
+		}
+	}
+	delete(w.deps, uri)
+}
+
+func (w *Watcher) stat(file string) fileState {
+	info, err := os.Stat(path.Join(w.basePath, file))
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{true, info.ModTime(), info.Size()}
+}
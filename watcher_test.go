@@ -0,0 +1,75 @@
+package push
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/test"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		test.Error(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), nil)
+	}
+	write("index.html", `<link rel="stylesheet" href="/style.css">`)
+	write("about.html", `<img src="/new.png">`)
+	write("other.html", ``)
+	write("style.css", `a { background: url(/bg.png); }`)
+	write("bg.png", ``)
+
+	w := NewWatcher(NewDefaultCache(), NewDefaultFileOpener(dir), 0)
+	defer w.Close()
+	w.Set("/", []string{"/style.css", "/bg.png"})
+	w.Set("/about.html?lang=en", []string{"/new.png"})
+	w.Set("/other.html", []string{})
+
+	test.String(t, strings.Join(w.Poll(), ","), "")
+
+	// changed
+	test.Error(t, os.Chtimes(filepath.Join(dir, "bg.png"), time.Now(), time.Now().Add(time.Hour)), nil)
+	// added
+	write("new.png", `png`)
+
+	deleted := w.Poll()
+	sort.Strings(deleted)
+	test.String(t, strings.Join(deleted, ","), "/,/about.html?lang=en")
+	_, ok := w.Get("/")
+	test.That(t, !ok)
+	_, ok = w.Get("/other.html")
+	test.That(t, ok)
+
+	// removed
+	test.Error(t, os.Remove(filepath.Join(dir, "other.html")), nil)
+	test.String(t, strings.Join(w.Poll(), ","), "/other.html")
+}
+
+func TestWatcherPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	test.Error(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	lru := NewLRUCache(1, 0, 0, 0)
+	w := NewWatcher(lru, NewDefaultFileOpener(dir), 0)
+	test.That(t, lru.OnEvict == nil, "cache is not changed")
+	lru.OnEvict = w.Forget
+	w.Set("/", []string{"/style.css", "/bg.png"})
+	w.Set("/about.html", []string{"/style.css"})
+	test.That(t, len(w.deps) == 1 && len(w.files) == 2, "evicted entry is pruned")
+	_, ok := w.files["/bg.png"]
+	test.That(t, !ok, "file of evicted entry is not tracked")
+
+	w.Del("/about.html")
+	test.That(t, len(w.deps) == 0 && len(w.files) == 0 && len(w.refs) == 0, "deleted entry is pruned")
+
+	test.Error(t, w.Close(), nil)
+	test.Error(t, w.Close(), nil)
+}